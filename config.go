@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/clientip"
+	"github.com/deyshin/openimg-go/internal/config"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/handler"
+	"github.com/deyshin/openimg-go/internal/pool"
+	"github.com/deyshin/openimg-go/internal/preset"
+	"github.com/deyshin/openimg-go/internal/ratelimit"
+	"github.com/deyshin/openimg-go/internal/source"
+	"github.com/deyshin/openimg-go/pkg/signature"
+)
+
+// loadConfig builds the server configuration from, in increasing order of
+// precedence, defaults, the config file, OPENIMG_* environment variables and
+// command line flags
+func loadConfig(args []string) (*config.Config, error) {
+	cfg, err := config.Load(configPath(args))
+	if err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.String("config", "", "YAML or JSON configuration file (also OPENIMG_CONFIG)")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "Address to listen on")
+	fs.DurationVar(&cfg.Server.ReadHeaderTimeout, "read-header-timeout", cfg.Server.ReadHeaderTimeout, "Timeout for reading request headers")
+	fs.DurationVar(&cfg.Server.ReadTimeout, "read-timeout", cfg.Server.ReadTimeout, "Timeout for reading a whole request")
+	fs.DurationVar(&cfg.Server.WriteTimeout, "write-timeout", cfg.Server.WriteTimeout, "Timeout for writing a response, including processing")
+	fs.DurationVar(&cfg.Server.IdleTimeout, "idle-timeout", cfg.Server.IdleTimeout, "Timeout for idle keep-alive connections")
+	fs.DurationVar(&cfg.Server.RequestTimeout, "request-timeout", cfg.Server.RequestTimeout, "Deadline for fetching and processing an image (0 for none)")
+	fs.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "Time in-flight requests get to finish on shutdown")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format: text or json")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Minimum log level: debug, info, warn or error")
+	fs.StringVar(&cfg.Cache, "cache", cfg.Cache, "Cache configuration (memory:100:4h, /tmp/cache, redis://localhost, or none)")
+	fs.StringVar(&cfg.SourceCache, "source-cache", cfg.SourceCache, "Cache for original image bytes, in the same format as -cache")
+	fs.DurationVar(&cfg.SourceCacheTTL, "source-cache-ttl", cfg.SourceCacheTTL, "Time after which cached originals are revalidated with their source")
+	fs.StringVar(&cfg.PresetFile, "presets", cfg.PresetFile, "YAML or JSON file of named transformation presets")
+	fs.StringVar(&cfg.PublicURL, "public-url", cfg.PublicURL, "Base URL of generated image URLs, e.g. https://img.example.com")
+	fs.Var(listFlag{&cfg.SigningKeys}, "signing-keys", "Comma-separated HMAC keys; when set, requests must be signed")
+	fs.IntVar(&cfg.Limits.MaxWidth, "max-width", cfg.Limits.MaxWidth, "Maximum output width")
+	fs.IntVar(&cfg.Limits.MaxHeight, "max-height", cfg.Limits.MaxHeight, "Maximum output height")
+	fs.Int64Var(&cfg.Limits.MaxSourceBytes, "max-source-bytes", cfg.Limits.MaxSourceBytes, "Maximum size of a source image in bytes (0 for no limit)")
+	fs.Int64Var(&cfg.Limits.MaxUploadBytes, "max-upload-bytes", cfg.Limits.MaxUploadBytes, "Maximum size of an uploaded image in bytes (0 for no limit)")
+	fs.Int64Var(&cfg.Limits.MaxPixels, "max-pixels", cfg.Limits.MaxPixels, "Maximum pixel count (width*height) of a source image (0 for no limit)")
+	fs.Var(qualityFlag(cfg.Quality), "quality", "Default quality for a format as 'format=quality', e.g. webp=80 (repeatable)")
+	fs.IntVar(&cfg.AVIFSpeed, "avif-speed", cfg.AVIFSpeed, "AVIF encoder speed 1-10 (0 for the default)")
+	fs.IntVar(&cfg.Pool.Concurrency, "concurrency", cfg.Pool.Concurrency, "Images processed at once (0 for no limit)")
+	fs.IntVar(&cfg.Pool.QueueSize, "queue-size", cfg.Pool.QueueSize, "Requests waiting to be processed before new ones get 503")
+	fs.DurationVar(&cfg.Pool.MaxWait, "queue-timeout", cfg.Pool.MaxWait, "Longest a request waits to be processed before getting 503 (0 for no limit)")
+	fs.IntVar(&cfg.Batch.MaxJobs, "batch-max-jobs", cfg.Batch.MaxJobs, "Maximum jobs in a batch request (0 for no limit)")
+	fs.IntVar(&cfg.Batch.Concurrency, "batch-concurrency", cfg.Batch.Concurrency, "Jobs of a batch request processed at once")
+	fs.StringVar(&cfg.Health.Upstream, "health-upstream", cfg.Health.Upstream, "URL fetched by /readyz to check upstream connectivity")
+	fs.DurationVar(&cfg.Health.Timeout, "health-timeout", cfg.Health.Timeout, "Deadline for each /readyz check")
+	fs.Var(listFlag{&cfg.AllowedOrigins}, "allowed-origins", "Comma-separated hosts remote images may be fetched from (empty allows all)")
+	fs.Float64Var(&cfg.RateLimit.Hits, "rate-limit-hits", cfg.RateLimit.Hits, "Requests per second served from the cache allowed per client, by API key or IP address (0 for no limit)")
+	fs.IntVar(&cfg.RateLimit.HitBurst, "rate-limit-hit-burst", cfg.RateLimit.HitBurst, "Cache hits a client may make at once (0 for the per-second rate)")
+	fs.Float64Var(&cfg.RateLimit.Misses, "rate-limit-misses", cfg.RateLimit.Misses, "Requests per second that miss the cache allowed per client (0 for no limit)")
+	fs.IntVar(&cfg.RateLimit.MissBurst, "rate-limit-miss-burst", cfg.RateLimit.MissBurst, "Cache-missing requests a client may make at once (0 for the per-second rate)")
+	fs.Var(listFlag{&cfg.RateLimit.TrustedProxies}, "trusted-proxies", "Comma-separated proxy addresses or CIDR ranges whose X-Forwarded-For is trusted")
+	fs.Var(listFlag{&cfg.CORS.AllowedOrigins}, "cors-origins", "Comma-separated origins allowed to make cross-origin requests, such as https://*.example.com, or *")
+	fs.BoolVar(&cfg.CORS.AllowCredentials, "cors-credentials", cfg.CORS.AllowCredentials, "Allow cross-origin requests with cookies or HTTP authentication")
+	fs.Var(listFlag{&cfg.CORS.AllowedHeaders}, "cors-allowed-headers", "Comma-separated request headers allowed in cross-origin requests (default Accept, Content-Type, and the API key headers when keys are configured)")
+	fs.Var(listFlag{&cfg.CORS.ExposedHeaders}, "cors-exposed-headers", "Comma-separated response headers readable by cross-origin scripts, e.g. ETag")
+	fs.DurationVar(&cfg.CORS.MaxAge, "cors-max-age", cfg.CORS.MaxAge, "How long browsers may cache CORS preflight responses")
+	fs.DurationVar(&cfg.Fetch.ConnectTimeout, "fetch-connect-timeout", cfg.Fetch.ConnectTimeout, "Timeout for connecting to upstream servers")
+	fs.DurationVar(&cfg.Fetch.ReadTimeout, "fetch-read-timeout", cfg.Fetch.ReadTimeout, "Timeout for upstream response headers")
+	fs.DurationVar(&cfg.Fetch.Timeout, "fetch-timeout", cfg.Fetch.Timeout, "Timeout for a whole upstream request")
+	fs.IntVar(&cfg.Fetch.Retries, "fetch-retries", cfg.Fetch.Retries, "Retries for upstream network errors and 5xx responses")
+	fs.DurationVar(&cfg.Fetch.RetryBackoff, "fetch-retry-backoff", cfg.Fetch.RetryBackoff, "Delay before the first upstream retry, doubled for each retry")
+	fs.IntVar(&cfg.Fetch.MaxRedirects, "fetch-max-redirects", cfg.Fetch.MaxRedirects, "Maximum upstream redirects to follow")
+	fs.Var(headerFlag(cfg.Fetch.Headers), "fetch-header", "Header sent upstream as 'Name: value' (repeatable)")
+	fs.Var(sourceFlag(cfg.Sources), "source", "Named image source as 'name=uri', e.g. local=file:///mnt/originals or assets=s3://bucket/prefix?region=eu-west-1 (repeatable)")
+	fs.Parse(args)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configPath finds the config file given with -config, falling back to
+// OPENIMG_CONFIG. It runs before the flags are parsed, as the file provides
+// their defaults.
+func configPath(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("OPENIMG_CONFIG")
+}
+
+// newLogger creates the logger described by cfg
+func newLogger(cfg config.Log) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// newImageHandler creates the image handler described by cfg
+func newImageHandler(cfg *config.Config) (*handler.ImageHandler, error) {
+	metrics := handler.NewMetrics()
+	fetchOpts := cfg.FetchOptions()
+	fetchOpts.Observe = metrics.ObserveFetch
+	fetcher := fetch.New(fetchOpts)
+	sources, err := handler.NewSources(cfg.Sources, fetcher)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &handler.ImageHandler{
+		Fetcher:        fetcher,
+		Sources:        sources,
+		Cache:          metrics.InstrumentCache(newCache(cfg.Cache), "image", cacheBackend(cfg.Cache)),
+		Limits:         cfg.ValidateLimits(),
+		MaxSourceBytes: cfg.Limits.MaxSourceBytes,
+		MaxUploadBytes: cfg.Limits.MaxUploadBytes,
+		MaxBatchJobs:   cfg.Batch.MaxJobs,
+		BatchWorkers:   cfg.Batch.Concurrency,
+		MaxPixels:      cfg.Limits.MaxPixels,
+		Quality:        cfg.Quality,
+		AVIFSpeed:      cfg.AVIFSpeed,
+		Timeout:        cfg.Server.RequestTimeout,
+		Metrics:        metrics,
+		AllowedOrigins: cfg.AllowedOrigins,
+		CORS:           cfg.CORSPolicy(),
+		PublicURL:      cfg.PublicURL,
+		HealthUpstream: cfg.Health.Upstream,
+		HealthTimeout:  cfg.Health.Timeout,
+	}
+	if cfg.Pool.Concurrency > 0 {
+		h.Pool = pool.New(cfg.Pool.Concurrency, cfg.Pool.QueueSize, cfg.Pool.MaxWait)
+		metrics.ObservePool(h.Pool)
+	}
+	if cfg.SourceCache != "" && cfg.SourceCache != "none" {
+		c := metrics.InstrumentCache(newCache(cfg.SourceCache), "source", cacheBackend(cfg.SourceCache))
+		h.SourceCache = source.NewCache(c, cfg.SourceCacheTTL, cfg.Limits.MaxSourceBytes)
+		if limit := cache.MaxEntrySize(c); limit > 0 && int64(limit) < cfg.Limits.MaxSourceBytes {
+			log.Printf("Warning: the %s source cache only holds originals of up to %d KB; use a disk cache to cache larger ones", cfg.SourceCache, limit/1024)
+		}
+	}
+
+	presets := &preset.Set{Presets: map[string]preset.Preset{}, Strict: cfg.StrictPresets}
+	for name, p := range cfg.Presets {
+		presets.Presets[name] = p
+	}
+	if cfg.PresetFile != "" {
+		loaded, err := preset.Load(cfg.PresetFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range loaded.Presets {
+			presets.Presets[name] = p
+		}
+		presets.Strict = presets.Strict || loaded.Strict
+	}
+	if len(presets.Presets) > 0 || presets.Strict {
+		h.Presets = presets
+		log.Printf("Loaded %d preset(s)", len(presets.Presets))
+	}
+
+	if len(cfg.SigningKeys) > 0 {
+		keys := make([][]byte, len(cfg.SigningKeys))
+		for i, k := range cfg.SigningKeys {
+			keys[i] = []byte(k)
+		}
+		h.Verifier = signature.NewVerifier(keys...)
+		h.Signer = signature.NewSigner(keys[0])
+		log.Printf("URL signing enabled with %d active key(s)", len(keys))
+	}
+
+	if rl := cfg.RateLimit; rl.Hits > 0 || rl.Misses > 0 {
+		proxies, err := clientip.New(rl.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		h.RateLimits = &handler.RateLimits{Proxies: proxies}
+		if rl.Hits > 0 {
+			h.RateLimits.Hits = ratelimit.NewLimiter(ratelimit.Limit{Rate: rl.Hits, Burst: rl.HitBurst})
+		}
+		if rl.Misses > 0 {
+			h.RateLimits.Misses = ratelimit.NewLimiter(ratelimit.Limit{Rate: rl.Misses, Burst: rl.MissBurst})
+		}
+		log.Printf("Rate limiting clients to %g cache hits/s, %g cache misses/s (0 is unlimited)", rl.Hits, rl.Misses)
+	}
+
+	if h.APIKeys, err = cfg.APIKeySet(); err != nil {
+		return nil, err
+	}
+	for _, key := range cfg.APIKeys {
+		for _, name := range key.AllowedPresets {
+			if _, ok := presets.Presets[name]; !ok {
+				return nil, fmt.Errorf("API key %q allows unknown preset %q", key.ID, name)
+			}
+		}
+	}
+	if h.APIKeys != nil {
+		log.Printf("API keys required, %d key(s) configured", len(cfg.APIKeys))
+	}
+	return h, nil
+}
+
+// listFlag sets a list from a comma-separated flag value
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	*f.list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f.list = append(*f.list, item)
+		}
+	}
+	return nil
+}
+
+// headerFlag collects repeated "Name: value" flags
+type headerFlag map[string]string
+
+func (f headerFlag) String() string {
+	return ""
+}
+
+func (f headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("header must be in the form 'Name: value'")
+	}
+	f[strings.TrimSpace(name)] = strings.TrimSpace(v)
+	return nil
+}
+
+// qualityFlag collects repeated "format=quality" flags
+type qualityFlag map[string]int
+
+func (f qualityFlag) String() string {
+	return ""
+}
+
+func (f qualityFlag) Set(value string) error {
+	format, q, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("quality must be in the form 'format=quality'")
+	}
+	n, err := strconv.Atoi(q)
+	if err != nil {
+		return fmt.Errorf("invalid quality %q", q)
+	}
+	f[format] = n
+	return nil
+}
+
+// sourceFlag collects repeated "name=uri" flags; the sources are created
+// once all flags, including the fetch options, have been parsed
+type sourceFlag map[string]string
+
+func (f sourceFlag) String() string {
+	return ""
+}
+
+func (f sourceFlag) Set(value string) error {
+	name, uri, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("source must be in the form 'name=uri'")
+	}
+	f[name] = uri
+	return nil
+}
@@ -11,7 +11,10 @@ require (
 	github.com/gen2brain/webp v0.5.0
 )
 
-require github.com/stretchr/testify v1.10.0
+require (
+	github.com/stretchr/testify v1.10.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
@@ -20,5 +23,4 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tetratelabs/wazero v1.8.1 // indirect
 	golang.org/x/image v0.0.0-20211028202545-6944b10bf410 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
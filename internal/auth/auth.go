@@ -0,0 +1,164 @@
+// Package auth implements API key authentication with per-key rate limits and
+// restrictions
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/ratelimit"
+)
+
+// Header is the request header carrying an API key. Keys are also accepted as
+// a bearer token in the Authorization header, or in the QueryParam query
+// parameter, for URLs used directly in pages.
+const (
+	Header     = "X-API-Key"
+	QueryParam = "key"
+)
+
+// MinSecretLen is the length keys must have at least, so they can't be guessed
+const MinSecretLen = 16
+
+var (
+	ErrMissingKey       = errors.New("API key required")
+	ErrInvalidKey       = errors.New("invalid API key")
+	ErrRateLimited      = errors.New("API key rate limit exceeded")
+	ErrPresetNotAllowed = errors.New("preset not allowed for API key")
+)
+
+// Key is an API key and what its holder may do
+type Key struct {
+	ID             string   // Identifies the key's holder in logs and metrics
+	Secret         string   // The key itself, as sent by clients
+	RateLimit      float64  // Requests per second; 0 means no limit
+	Burst          int      // Requests allowed at once; 0 means ceil(RateLimit)
+	AllowedOrigins []string // Hosts remote images may be fetched from; empty allows all
+	AllowedPresets []string // Presets the key must use; empty allows any request
+}
+
+// Keys is a set of API keys. It is safe for concurrent use.
+type Keys struct {
+	keys    map[[sha256.Size]byte]*Key
+	buckets map[string]*ratelimit.Bucket // By key ID
+}
+
+// New checks keys and returns them as a set
+func New(keys []Key) (*Keys, error) {
+	s := &Keys{
+		keys:    make(map[[sha256.Size]byte]*Key, len(keys)),
+		buckets: make(map[string]*ratelimit.Bucket, len(keys)),
+	}
+	for i := range keys {
+		k := &keys[i]
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(k.Secret))
+		if _, ok := s.keys[sum]; ok {
+			return nil, fmt.Errorf("API key %q: key is already used by another key", k.ID)
+		}
+		if _, ok := s.buckets[k.ID]; ok {
+			return nil, fmt.Errorf("API key %q: id is already used by another key", k.ID)
+		}
+		s.keys[sum] = k
+		s.buckets[k.ID] = ratelimit.NewBucket(ratelimit.Limit{Rate: k.RateLimit, Burst: k.Burst})
+	}
+	return s, nil
+}
+
+func (k *Key) validate() error {
+	switch {
+	case k.ID == "":
+		return errors.New("API key id is required")
+	case strings.ContainsAny(k.ID, " \t\r\n\"\\"):
+		return fmt.Errorf("API key %q: id must not contain spaces or quotes", k.ID)
+	case len(k.Secret) < MinSecretLen:
+		return fmt.Errorf("API key %q: key must be at least %d characters", k.ID, MinSecretLen)
+	case k.RateLimit < 0 || k.Burst < 0:
+		return fmt.Errorf("API key %q: rate limit and burst must not be negative", k.ID)
+	}
+	return nil
+}
+
+// Authenticate returns the key r was made with
+func (s *Keys) Authenticate(r *http.Request) (*Key, error) {
+	secret := FromRequest(r)
+	if secret == "" {
+		return nil, ErrMissingKey
+	}
+	// Keys are looked up by hash so that the lookup's timing says nothing
+	// about how close a guess was
+	sum := sha256.Sum256([]byte(secret))
+	k, ok := s.keys[sum]
+	if !ok || subtle.ConstantTimeCompare([]byte(k.Secret), []byte(secret)) != 1 {
+		return nil, ErrInvalidKey
+	}
+	return k, nil
+}
+
+// Allow takes a request from k's rate limit at now, returning
+// ErrRateLimited if none is left
+func (s *Keys) Allow(k *Key, now time.Time) (ratelimit.Decision, error) {
+	b, ok := s.buckets[k.ID]
+	if !ok {
+		return ratelimit.Decision{Allowed: true}, nil
+	}
+	d := b.Allow(now)
+	if !d.Allowed {
+		return d, fmt.Errorf("%w for %q", ErrRateLimited, k.ID)
+	}
+	return d, nil
+}
+
+// FromRequest returns the API key sent with r, or "" if there is none
+func FromRequest(r *http.Request) string {
+	if key := FromHeader(r); key != "" {
+		return key
+	}
+	return r.URL.Query().Get(QueryParam)
+}
+
+// FromHeader returns the API key sent in the headers of r, ignoring the
+// query, or "" if there is none
+func FromHeader(r *http.Request) string {
+	if key := r.Header.Get(Header); key != "" {
+		return key
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// AllowPreset checks that k may make a request with the named preset, or
+// without one if name is empty
+func (k *Key) AllowPreset(name string) error {
+	if k == nil || len(k.AllowedPresets) == 0 || slices.Contains(k.AllowedPresets, name) {
+		return nil
+	}
+	if name == "" {
+		return fmt.Errorf("%w: %q must use one of the presets %s", ErrPresetNotAllowed, k.ID, strings.Join(k.AllowedPresets, ", "))
+	}
+	return fmt.Errorf("%w: %q cannot use %q", ErrPresetNotAllowed, k.ID, name)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying k
+func NewContext(ctx context.Context, k *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, k)
+}
+
+// FromContext returns the key in ctx, or nil if there is none
+func FromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(contextKey{}).(*Key)
+	return k
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -9,16 +10,49 @@ import (
 
 var ErrNotFound = errors.New("item not found in cache")
 
+// Cache stores rendered images by key. The context bounds calls to remote
+// caches; local caches may ignore it.
 type Cache interface {
-	Get(key string) ([]byte, error)
-	Set(key string, value []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// Pinger is implemented by caches that can check that their backend is
+// reachable and usable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks c if it depends on a backend, such as a DiskCache. Caches that
+// cannot fail, such as a MemoryCache, are always healthy.
+func Ping(ctx context.Context, c Cache) error {
+	if pinger, ok := c.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// EntryLimiter is implemented by caches that only store entries up to a size
+type EntryLimiter interface {
+	MaxEntrySize() int
+}
+
+// MaxEntrySize returns the largest entry c can store, counting its key and
+// value, or 0 if c doesn't limit the size of entries
+func MaxEntrySize(c Cache) int {
+	if limiter, ok := c.(EntryLimiter); ok {
+		return limiter.MaxEntrySize()
+	}
+	return 0
 }
 
 // Package-level constructor functions
 func NewMemoryCache(sizeMB int, ttl time.Duration) Cache {
 	sizeBytes := sizeMB * 1024 * 1024
 	return &MemoryCache{
-		cache: freecache.NewCache(sizeBytes),
+		cache:         freecache.NewCache(sizeBytes),
+		size:          sizeBytes,
+		expireSeconds: int(ttl / time.Second),
 	}
 }
 
@@ -38,4 +72,4 @@ type Options struct {
 	Size int    // Size in MB for memory cache
 	TTL  time.Duration
 	Path string // Path for disk cache or URL for remote caches
-}
\ No newline at end of file
+}
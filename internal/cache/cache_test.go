@@ -1,9 +1,12 @@
 package cache
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -15,8 +18,8 @@ func TestCache(t *testing.T) {
 	key := "test_key"
 	data := []byte("test_data")
 
-	cache.Set(key, data)
-	got, err := cache.Get(key)
+	cache.Set(context.Background(), key, data)
+	got, err := cache.Get(context.Background(), key)
 
 	if err != nil {
 		t.Error("Expected to find key in cache")
@@ -27,12 +30,27 @@ func TestCache(t *testing.T) {
 	}
 
 	// Test key not found
-	_, err = cache.Get("nonexistent")
+	_, err = cache.Get(context.Background(), "nonexistent")
 	if err != ErrNotFound {
 		t.Error("Expected key to not be found")
 	}
 }
 
+func TestMemoryCache_MaxEntrySize(t *testing.T) {
+	c := NewMemoryCache(1, 0)
+	limit := MaxEntrySize(c)
+	key := "k"
+	if err := c.Set(context.Background(), key, make([]byte, limit-len(key))); err != nil {
+		t.Errorf("Set() of an entry of MaxEntrySize() = %d bytes failed: %v", limit, err)
+	}
+	if err := c.Set(context.Background(), key, make([]byte, limit-len(key)+1)); err == nil {
+		t.Errorf("Set() of an entry over MaxEntrySize() = %d bytes succeeded", limit)
+	}
+	if got := MaxEntrySize(NewNoopCache()); got != 0 {
+		t.Errorf("MaxEntrySize(NoopCache) = %d, want 0", got)
+	}
+}
+
 func TestNoopCache(t *testing.T) {
 	cache := NewNoopCache()
 
@@ -40,8 +58,8 @@ func TestNoopCache(t *testing.T) {
 	key := "test_key"
 	data := []byte("test_data")
 
-	cache.Set(key, data)
-	got, err := cache.Get(key)
+	cache.Set(context.Background(), key, data)
+	got, err := cache.Get(context.Background(), key)
 
 	if err != ErrNotFound {
 		t.Error("Expected key to not be found")
@@ -65,8 +83,8 @@ func TestDiskCache(t *testing.T) {
 	key := "test_key"
 	data := []byte("test_data")
 
-	cache.Set(key, data)
-	got, err := cache.Get(key)
+	cache.Set(context.Background(), key, data)
+	got, err := cache.Get(context.Background(), key)
 
 	if err != nil {
 		t.Error("Expected to find key in cache")
@@ -77,10 +95,17 @@ func TestDiskCache(t *testing.T) {
 	}
 
 	// Test key not found
-	_, err = cache.Get("nonexistent")
+	_, err = cache.Get(context.Background(), "nonexistent")
 	if err != ErrNotFound {
 		t.Error("Expected key to not be found")
 	}
+
+	if err := Ping(context.Background(), cache); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	if err := Ping(context.Background(), NewDiskCache(filepath.Join(dir, "missing"))); err == nil {
+		t.Error("Ping() of a missing directory succeeded")
+	}
 }
 
 func TestGenerateKey(t *testing.T) {
@@ -126,3 +151,31 @@ func TestGenerateKey(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteBackCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewWriteBackCache(NewDiskCache(dir), 4)
+
+	// More writes than the queue holds, with some keys written twice
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key_%d", i%10)
+		if err := cache.Set(context.Background(), key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cache.Get(context.Background(), key); err != nil || string(got) != fmt.Sprint(i) {
+			t.Errorf("Get(%s) = %s, %v, want %d", key, got, err, i)
+		}
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything must be on disk after Close
+	disk := NewDiskCache(dir)
+	for i := 10; i < 20; i++ {
+		key := fmt.Sprintf("key_%d", i%10)
+		if got, err := disk.Get(context.Background(), key); err != nil || string(got) != fmt.Sprint(i) {
+			t.Errorf("disk Get(%s) = %s, %v, want %d", key, got, err, i)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
@@ -10,7 +11,7 @@ type DiskCache struct {
 	basePath string
 }
 
-func (c *DiskCache) Get(key string) ([]byte, error) {
+func (c *DiskCache) Get(ctx context.Context, key string) ([]byte, error) {
 	filePath := filepath.Join(c.basePath, key)
 	file, err := os.Open(filePath)
 	if os.IsNotExist(err) {
@@ -28,17 +29,31 @@ func (c *DiskCache) Get(key string) ([]byte, error) {
 	return data, nil
 }
 
-func (c *DiskCache) Set(key string, value []byte) error {
-	filePath := filepath.Join(c.basePath, key)
-	file, err := os.Create(filePath)
+func (c *DiskCache) Set(ctx context.Context, key string, value []byte) error {
+	// Write to a temporary file and rename it into place, so readers and
+	// interrupted writes never leave a partial entry behind
+	file, err := os.CreateTemp(c.basePath, ".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(c.basePath, key))
+}
 
-	_, err = file.Write(value)
+// Ping checks that the cache directory exists and is writable
+func (c *DiskCache) Ping(ctx context.Context) error {
+	file, err := os.CreateTemp(c.basePath, ".ping-*")
 	if err != nil {
 		return err
 	}
-	return nil
+	file.Close()
+	return os.Remove(file.Name())
 }
@@ -16,4 +16,11 @@ func GenerateKey(url string, width, height, quality int, format, fit string) str
 	h := sha256.New()
 	h.Write([]byte(key))
 	return base64.URLEncoding.EncodeToString(h.Sum(nil))
-}
\ No newline at end of file
+}
+
+// SourceKey generates a cache key for the original bytes of an image
+func SourceKey(id string) string {
+	h := sha256.New()
+	h.Write([]byte("source_" + id))
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -1,14 +1,18 @@
 package cache
 
 import (
+	"context"
+
 	"github.com/coocood/freecache"
 )
 
 type MemoryCache struct {
-	cache *freecache.Cache
+	cache         *freecache.Cache
+	size          int // In bytes
+	expireSeconds int // 0 means entries only leave the cache when evicted
 }
 
-func (c *MemoryCache) Get(key string) ([]byte, error) {
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
 	data, err := c.cache.Get([]byte(key))
 	if err == freecache.ErrNotFound {
 		return nil, ErrNotFound
@@ -19,6 +23,14 @@ func (c *MemoryCache) Get(key string) ([]byte, error) {
 	return data, nil
 }
 
-func (c *MemoryCache) Set(key string, value []byte) error {
-	return c.cache.Set([]byte(key), value, 3600)
-}
\ No newline at end of file
+func (c *MemoryCache) Set(ctx context.Context, key string, value []byte) error {
+	return c.cache.Set([]byte(key), value, c.expireSeconds)
+}
+
+// MaxEntrySize returns the largest entry the cache accepts. freecache splits
+// the cache into 256 segments and rejects entries over a quarter of one, less
+// its 24-byte entry header, so a 100MB cache holds entries of up to about
+// 100KB.
+func (c *MemoryCache) MaxEntrySize() int {
+	return max(c.size, 512*1024)/1024 - 24
+}
@@ -1,11 +1,13 @@
 package cache
 
+import "context"
+
 type NoopCache struct{}
 
-func (c *NoopCache) Get(key string) ([]byte, error) {
-    return nil, ErrNotFound
+func (c *NoopCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, ErrNotFound
 }
 
-func (c *NoopCache) Set(key string, value []byte) error {
-    return nil
-}
\ No newline at end of file
+func (c *NoopCache) Set(ctx context.Context, key string, value []byte) error {
+	return nil
+}
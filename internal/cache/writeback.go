@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// WriteBackCache defers writes to a slower cache, such as a DiskCache, to a
+// background goroutine so that responses don't wait for them. Values are
+// served from memory until written. When the queue is full, Set writes
+// through. Close flushes pending writes and must be called before exit.
+type WriteBackCache struct {
+	cache Cache
+
+	mu      sync.Mutex
+	pending map[string]*pendingValue
+	queue   chan string
+	closed  bool
+	done    chan struct{}
+}
+
+// pendingValue is a value waiting to be written; a new pointer is stored when
+// a queued key is set again, so the writer can tell the value changed
+type pendingValue struct {
+	ctx   context.Context // The setter's context, without its cancellation
+	value []byte
+}
+
+// NewWriteBackCache creates a write-back cache in front of c, buffering up to
+// size writes
+func NewWriteBackCache(c Cache, size int) *WriteBackCache {
+	wb := &WriteBackCache{
+		cache:   c,
+		pending: make(map[string]*pendingValue),
+		queue:   make(chan string, size),
+		done:    make(chan struct{}),
+	}
+	go wb.run()
+	return wb
+}
+
+func (c *WriteBackCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	p, ok := c.pending[key]
+	c.mu.Unlock()
+	if ok {
+		return p.value, nil
+	}
+	return c.cache.Get(ctx, key)
+}
+
+func (c *WriteBackCache) Set(ctx context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	if _, queued := c.pending[key]; queued {
+		c.pending[key] = &pendingValue{context.WithoutCancel(ctx), value}
+		c.mu.Unlock()
+		return nil
+	}
+	if !c.closed {
+		select {
+		case c.queue <- key:
+			c.pending[key] = &pendingValue{context.WithoutCancel(ctx), value}
+			c.mu.Unlock()
+			return nil
+		default:
+		}
+	}
+	c.mu.Unlock()
+	return c.cache.Set(ctx, key, value)
+}
+
+// Close writes all pending values and closes the underlying cache
+func (c *WriteBackCache) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	<-c.done
+	return Close(c.cache)
+}
+
+// Ping checks the underlying cache
+func (c *WriteBackCache) Ping(ctx context.Context) error {
+	return Ping(ctx, c.cache)
+}
+
+func (c *WriteBackCache) run() {
+	defer close(c.done)
+	for key := range c.queue {
+		for written := false; !written; {
+			c.mu.Lock()
+			p := c.pending[key]
+			c.mu.Unlock()
+
+			c.cache.Set(p.ctx, key, p.value)
+
+			// Remove the entry only once it can be read from the cache, and
+			// write again if it was set meanwhile
+			c.mu.Lock()
+			if written = c.pending[key] == p; written {
+				delete(c.pending, key)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes and closes c if it holds resources, such as a WriteBackCache
+func Close(c Cache) error {
+	if closer, ok := c.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Package clientip determines the address of the client behind a request,
+// trusting X-Forwarded-For only when it was set by a known proxy
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver finds client addresses. A nil *Resolver trusts no proxies and
+// always uses the address of the connection.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// New returns a resolver trusting the proxies at proxies, given as
+// addresses such as 10.0.0.1 or CIDR ranges such as 10.0.0.0/8
+func New(proxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("trusted proxy %q must be an IP address or CIDR range", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+	return r, nil
+}
+
+// ClientIP returns the address of the client making req. If the connection
+// comes from a trusted proxy, X-Forwarded-For is read from the right,
+// skipping the addresses of trusted proxies; the first other address is the
+// client's, as anything before it may have been sent by the client itself.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	addr, ok := parseAddr(req.RemoteAddr)
+	if !ok {
+		return req.RemoteAddr
+	}
+	if r == nil || !r.trustedAddr(addr) {
+		return addr.String()
+	}
+
+	hops := forwardedFor(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			// A malformed entry can't be trusted, nor anything before it
+			break
+		}
+		addr = hop
+		if !r.trustedAddr(hop) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func (r *Resolver) trustedAddr(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses in the X-Forwarded-For headers, in order
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseAddr parses an address with or without a port, unmapping IPv4
+// addresses in IPv6 form so they match IPv4 ranges
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
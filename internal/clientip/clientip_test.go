@@ -0,0 +1,51 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolver_ClientIP(t *testing.T) {
+	proxies, err := New([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		resolver   *Resolver
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", proxies, "203.0.113.7:4321", nil, "203.0.113.7"},
+		{"untrusted peer's header ignored", proxies, "203.0.113.7:4321", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"nil resolver trusts no one", nil, "10.0.0.1:80", []string{"198.51.100.1"}, "10.0.0.1"},
+		{"trusted proxy", proxies, "10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", proxies, "10.1.2.3:80", []string{"198.51.100.1, 192.0.2.1, 10.9.9.9"}, "198.51.100.1"},
+		{"spoofed entries before the client", proxies, "10.1.2.3:80", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"several headers", proxies, "10.1.2.3:80", []string{"198.51.100.1", "10.9.9.9"}, "198.51.100.1"},
+		{"only proxies", proxies, "10.1.2.3:80", []string{"10.2.2.2"}, "10.2.2.2"},
+		{"malformed entry", proxies, "10.1.2.3:80", []string{"198.51.100.1, garbage"}, "10.1.2.3"},
+		{"entry with port", proxies, "10.1.2.3:80", []string{"198.51.100.1:5555"}, "198.51.100.1"},
+		{"IPv6", proxies, "[2001:db8::1]:443", []string{"2001:db9::5"}, "2001:db9::5"},
+		{"IPv4-mapped peer", proxies, "[::ffff:10.1.2.3]:80", []string{"198.51.100.1"}, "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := tt.resolver.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := New([]string{"proxy.example.com"}); err == nil {
+		t.Error("New() accepted a host name")
+	}
+}
@@ -0,0 +1,490 @@
+// Package config loads the server configuration from a YAML or JSON file and
+// OPENIMG_* environment variables, and validates it.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/clientip"
+	"github.com/deyshin/openimg-go/internal/cors"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/preset"
+	"github.com/deyshin/openimg-go/internal/validate"
+)
+
+// Config is the server configuration
+type Config struct {
+	Listen         string                   `yaml:"listen"`
+	PublicURL      string                   `yaml:"publicURL"` // Base of generated image URLs; empty makes them root-relative
+	Server         Server                   `yaml:"server"`
+	Log            Log                      `yaml:"log"`
+	Cache          string                   `yaml:"cache"`       // Rendition cache, e.g. memory:100:4h or a directory
+	SourceCache    string                   `yaml:"sourceCache"` // Original bytes cache, same format as Cache
+	SourceCacheTTL time.Duration            `yaml:"sourceCacheTTL"`
+	Limits         Limits                   `yaml:"limits"`
+	Quality        map[string]int           `yaml:"quality"` // Default quality per output format
+	AVIFSpeed      int                      `yaml:"avifSpeed"`
+	Pool           Pool                     `yaml:"pool"`
+	Batch          Batch                    `yaml:"batch"`
+	Health         Health                   `yaml:"health"`
+	AllowedOrigins []string                 `yaml:"allowedOrigins"` // Hosts remote images may be fetched from; empty allows all
+	CORS           CORS                     `yaml:"cors"`
+	Fetch          Fetch                    `yaml:"fetch"`
+	Sources        map[string]string        `yaml:"sources"` // Named sources as URIs
+	SigningKeys    []string                 `yaml:"signingKeys"`
+	Presets        map[string]preset.Preset `yaml:"presets"`
+	StrictPresets  bool                     `yaml:"strictPresets"`
+	PresetFile     string                   `yaml:"presetFile"` // Additional presets loaded from a separate file
+	APIKeys        []APIKey                 `yaml:"apiKeys"`    // Keys clients must authenticate with; empty disables API keys
+	RateLimit      RateLimit                `yaml:"rateLimit"`
+}
+
+// Server configures the HTTP server. Zero timeouts mean no timeout.
+type Server struct {
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"` // Must allow for the slowest encode
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"` // Time in-flight requests get to finish on shutdown
+	RequestTimeout    time.Duration `yaml:"requestTimeout"`  // Deadline for fetching and processing an image
+}
+
+// Limits bounds requests and source images
+type Limits struct {
+	MaxWidth       int   `yaml:"maxWidth"`
+	MaxHeight      int   `yaml:"maxHeight"`
+	MaxSourceBytes int64 `yaml:"maxSourceBytes"` // 0 means no limit
+	MaxUploadBytes int64 `yaml:"maxUploadBytes"` // 0 means no limit
+	MaxPixels      int64 `yaml:"maxPixels"`      // 0 means no limit
+}
+
+// Log configures logging
+type Log struct {
+	Format string `yaml:"format"` // "text" or "json"
+	Level  string `yaml:"level"`  // "debug", "info", "warn" or "error"
+}
+
+// Pool limits concurrent decoding, transforming and encoding
+type Pool struct {
+	Concurrency int           `yaml:"concurrency"` // Images processed at once; 0 means no limit
+	QueueSize   int           `yaml:"queueSize"`   // Requests waiting for a worker before 503s
+	MaxWait     time.Duration `yaml:"maxWait"`     // Longest a request waits for a worker; 0 means no limit
+}
+
+// Batch configures batch requests
+type Batch struct {
+	MaxJobs     int `yaml:"maxJobs"`     // Jobs accepted in a batch; 0 means no limit
+	Concurrency int `yaml:"concurrency"` // Jobs of a batch run at once
+}
+
+// Health configures the readiness probe
+type Health struct {
+	Upstream string        `yaml:"upstream"` // URL fetched to check upstream connectivity; empty skips the check
+	Timeout  time.Duration `yaml:"timeout"`  // Deadline for each readiness check
+}
+
+// CORS configures cross-origin access to the image endpoints
+type CORS struct {
+	AllowedOrigins   []string      `yaml:"allowedOrigins"` // Origins, patterns such as https://*.example.com, or *
+	AllowCredentials bool          `yaml:"allowCredentials"`
+	AllowedHeaders   []string      `yaml:"allowedHeaders"` // Request headers allowed in preflighted requests
+	ExposedHeaders   []string      `yaml:"exposedHeaders"` // Response headers readable by scripts, e.g. ETag
+	MaxAge           time.Duration `yaml:"maxAge"`         // How long browsers may cache preflight responses
+}
+
+// APIKey is a key clients authenticate with, and what its holder may do
+type APIKey struct {
+	ID             string   `yaml:"id"`             // Identifies the key's holder in logs and metrics
+	Key            string   `yaml:"key"`            // The key itself, at least 16 characters
+	RateLimit      float64  `yaml:"rateLimit"`      // Requests per second; 0 means no limit
+	Burst          int      `yaml:"burst"`          // Requests allowed at once; 0 means ceil(rateLimit)
+	AllowedOrigins []string `yaml:"allowedOrigins"` // Hosts remote images may be fetched from; empty allows all
+	AllowedPresets []string `yaml:"allowedPresets"` // Presets the key must use; empty allows any request
+}
+
+// RateLimit limits the requests each client, identified by API key or IP
+// address, may make. Zero rates mean no limit.
+type RateLimit struct {
+	Hits           float64  `yaml:"hits"`           // Requests per second served from the cache
+	HitBurst       int      `yaml:"hitBurst"`       // Requests allowed at once; 0 means ceil(hits)
+	Misses         float64  `yaml:"misses"`         // Requests per second that miss the cache
+	MissBurst      int      `yaml:"missBurst"`      // Cache misses allowed at once; 0 means ceil(misses)
+	TrustedProxies []string `yaml:"trustedProxies"` // Addresses or CIDR ranges whose X-Forwarded-For is trusted
+}
+
+// Fetch configures upstream requests
+type Fetch struct {
+	ConnectTimeout time.Duration     `yaml:"connectTimeout"`
+	ReadTimeout    time.Duration     `yaml:"readTimeout"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	Retries        int               `yaml:"retries"`
+	RetryBackoff   time.Duration     `yaml:"retryBackoff"`
+	MaxRedirects   int               `yaml:"maxRedirects"`
+	Headers        map[string]string `yaml:"headers"`
+}
+
+// Default returns the configuration used when nothing is configured
+func Default() *Config {
+	f := fetch.DefaultOptions()
+	headers := map[string]string{}
+	for name := range f.Header {
+		headers[name] = f.Header.Get(name)
+	}
+
+	return &Config{
+		Listen:         ":8080",
+		SourceCacheTTL: 10 * time.Minute,
+		Limits: Limits{
+			MaxWidth:       validate.MaxWidth,
+			MaxHeight:      validate.MaxHeight,
+			MaxSourceBytes: validate.DefaultMaxSourceBytes,
+			MaxUploadBytes: validate.DefaultMaxUploadBytes,
+			MaxPixels:      validate.DefaultMaxPixels,
+		},
+		Quality: map[string]int{
+			"jpeg": 85,
+			"webp": 85,
+			"avif": 85,
+		},
+		Pool: Pool{
+			Concurrency: runtime.NumCPU(),
+			QueueSize:   64,
+			MaxWait:     10 * time.Second,
+		},
+		Batch: Batch{
+			MaxJobs:     1000,
+			Concurrency: runtime.NumCPU(),
+		},
+		Health: Health{Timeout: 2 * time.Second},
+		CORS:   CORS{AllowedOrigins: []string{"*"}},
+		Fetch: Fetch{
+			ConnectTimeout: f.ConnectTimeout,
+			ReadTimeout:    f.ReadTimeout,
+			Timeout:        f.Timeout,
+			Retries:        f.Retries,
+			RetryBackoff:   f.RetryBackoff,
+			MaxRedirects:   f.MaxRedirects,
+			Headers:        headers,
+		},
+		Sources: map[string]string{},
+		Log:     Log{Format: "text", Level: "info"},
+		Server: Server{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			RequestTimeout:    45 * time.Second,
+		},
+	}
+}
+
+// Load returns the default configuration, overridden by the file at path (if
+// path is not empty) and then by environment variables
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// YAML is a superset of JSON, so both formats are accepted. Fields
+		// missing from the file keep their defaults.
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		// An empty key such as "quality:" unmarshals to a nil map, which
+		// flags and environment variables then can't add to
+		if cfg.Quality == nil {
+			cfg.Quality = map[string]int{}
+		}
+		if cfg.Sources == nil {
+			cfg.Sources = map[string]string{}
+		}
+		if cfg.Fetch.Headers == nil {
+			cfg.Fetch.Headers = map[string]string{}
+		}
+	}
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides cfg with the OPENIMG_* environment variables. PORT is
+// also honoured for compatibility.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v := getenv(name); v != "" {
+			*dst = splitList(v)
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid integer %q", name, v))
+			}
+			*dst = n
+		}
+	}
+	integer64 := func(name string, dst *int64) {
+		if v := getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid integer %q", name, v))
+			}
+			*dst = n
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid boolean %q", name, v))
+			}
+			*dst = b
+		}
+	}
+	number := func(name string, dst *float64) {
+		if v := getenv(name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", name, v))
+			}
+			*dst = n
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", name, v))
+			}
+			*dst = d
+		}
+	}
+
+	if port := getenv("PORT"); port != "" {
+		c.Listen = ":" + port
+	}
+	str("OPENIMG_LISTEN", &c.Listen)
+	str("OPENIMG_PUBLIC_URL", &c.PublicURL)
+	duration("OPENIMG_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	duration("OPENIMG_READ_TIMEOUT", &c.Server.ReadTimeout)
+	duration("OPENIMG_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	duration("OPENIMG_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	duration("OPENIMG_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	duration("OPENIMG_REQUEST_TIMEOUT", &c.Server.RequestTimeout)
+	str("OPENIMG_LOG_FORMAT", &c.Log.Format)
+	str("OPENIMG_LOG_LEVEL", &c.Log.Level)
+	str("OPENIMG_CACHE", &c.Cache)
+	str("OPENIMG_SOURCE_CACHE", &c.SourceCache)
+	duration("OPENIMG_SOURCE_CACHE_TTL", &c.SourceCacheTTL)
+	integer("OPENIMG_MAX_WIDTH", &c.Limits.MaxWidth)
+	integer("OPENIMG_MAX_HEIGHT", &c.Limits.MaxHeight)
+	integer64("OPENIMG_MAX_SOURCE_BYTES", &c.Limits.MaxSourceBytes)
+	integer64("OPENIMG_MAX_UPLOAD_BYTES", &c.Limits.MaxUploadBytes)
+	integer64("OPENIMG_MAX_PIXELS", &c.Limits.MaxPixels)
+	for _, format := range []string{"jpeg", "webp", "avif"} {
+		name := "OPENIMG_QUALITY_" + strings.ToUpper(format)
+		if getenv(name) == "" {
+			continue
+		}
+		if c.Quality == nil {
+			c.Quality = map[string]int{}
+		}
+		q := c.Quality[format]
+		integer(name, &q)
+		c.Quality[format] = q
+	}
+	integer("OPENIMG_AVIF_SPEED", &c.AVIFSpeed)
+	integer("OPENIMG_CONCURRENCY", &c.Pool.Concurrency)
+	integer("OPENIMG_QUEUE_SIZE", &c.Pool.QueueSize)
+	duration("OPENIMG_QUEUE_TIMEOUT", &c.Pool.MaxWait)
+	integer("OPENIMG_BATCH_MAX_JOBS", &c.Batch.MaxJobs)
+	integer("OPENIMG_BATCH_CONCURRENCY", &c.Batch.Concurrency)
+	str("OPENIMG_HEALTH_UPSTREAM", &c.Health.Upstream)
+	duration("OPENIMG_HEALTH_TIMEOUT", &c.Health.Timeout)
+	list("OPENIMG_ALLOWED_ORIGINS", &c.AllowedOrigins)
+	list("OPENIMG_CORS_ORIGINS", &c.CORS.AllowedOrigins)
+	boolean("OPENIMG_CORS_CREDENTIALS", &c.CORS.AllowCredentials)
+	list("OPENIMG_CORS_ALLOWED_HEADERS", &c.CORS.AllowedHeaders)
+	list("OPENIMG_CORS_EXPOSED_HEADERS", &c.CORS.ExposedHeaders)
+	duration("OPENIMG_CORS_MAX_AGE", &c.CORS.MaxAge)
+	list("OPENIMG_SIGNING_KEYS", &c.SigningKeys)
+	number("OPENIMG_RATE_LIMIT_HITS", &c.RateLimit.Hits)
+	integer("OPENIMG_RATE_LIMIT_HIT_BURST", &c.RateLimit.HitBurst)
+	number("OPENIMG_RATE_LIMIT_MISSES", &c.RateLimit.Misses)
+	integer("OPENIMG_RATE_LIMIT_MISS_BURST", &c.RateLimit.MissBurst)
+	list("OPENIMG_TRUSTED_PROXIES", &c.RateLimit.TrustedProxies)
+	str("OPENIMG_PRESETS", &c.PresetFile)
+	return errors.Join(errs...)
+}
+
+// Validate checks the configuration, reporting every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen: address is required")
+	check(c.PublicURL == "" || strings.HasPrefix(c.PublicURL, "http://") || strings.HasPrefix(c.PublicURL, "https://"),
+		"publicURL: must be an http or https URL")
+	check(c.Server.ReadHeaderTimeout >= 0 && c.Server.ReadTimeout >= 0 && c.Server.WriteTimeout >= 0 &&
+		c.Server.IdleTimeout >= 0 && c.Server.ShutdownTimeout >= 0 && c.Server.RequestTimeout >= 0, "server: timeouts must not be negative")
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format: must be text or json")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level: must be debug, info, warn or error")
+	check(c.SourceCacheTTL >= 0, "sourceCacheTTL: must not be negative")
+	check(c.Limits.MaxWidth >= validate.MinWidth, "limits.maxWidth: must be at least %d", validate.MinWidth)
+	check(c.Limits.MaxHeight >= validate.MinHeight, "limits.maxHeight: must be at least %d", validate.MinHeight)
+	check(c.Limits.MaxSourceBytes >= 0, "limits.maxSourceBytes: must not be negative")
+	check(c.Limits.MaxUploadBytes >= 0, "limits.maxUploadBytes: must not be negative")
+	check(c.Limits.MaxPixels >= 0, "limits.maxPixels: must not be negative")
+	for format, q := range c.Quality {
+		check(format != "jpg", "quality.jpg: use jpeg")
+		check(format == "jpeg" || format == "jpg" || format == "webp" || format == "avif",
+			"quality.%s: quality can only be set for jpeg, webp and avif", format)
+		check(q >= 1 && q <= 100, "quality.%s: must be between 1 and 100", format)
+	}
+	check(c.AVIFSpeed >= 0 && c.AVIFSpeed <= 10, "avifSpeed: must be between 1 and 10, or 0 for the default")
+	check(c.Pool.Concurrency >= 0, "pool.concurrency: must not be negative")
+	check(c.Pool.QueueSize >= 0, "pool.queueSize: must not be negative")
+	check(c.Pool.MaxWait >= 0, "pool.maxWait: must not be negative")
+	check(c.Batch.MaxJobs >= 0, "batch.maxJobs: must not be negative")
+	check(c.Batch.Concurrency >= 1, "batch.concurrency: must be at least 1")
+	check(c.Health.Upstream == "" || strings.HasPrefix(c.Health.Upstream, "http://") ||
+		strings.HasPrefix(c.Health.Upstream, "https://"), "health.upstream: must be an http or https URL")
+	check(c.Health.Timeout >= 0, "health.timeout: must not be negative")
+	for _, origin := range c.AllowedOrigins {
+		check(origin != "" && !strings.Contains(origin, "/"), "allowedOrigins: %q must be a host name", origin)
+	}
+	if err := c.CORSPolicy().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("cors: %w", err))
+	}
+	check(c.Fetch.ConnectTimeout >= 0 && c.Fetch.ReadTimeout >= 0 && c.Fetch.Timeout >= 0,
+		"fetch: timeouts must not be negative")
+	check(c.Fetch.Retries >= 0, "fetch.retries: must not be negative")
+	check(c.Fetch.MaxRedirects >= 0, "fetch.maxRedirects: must not be negative")
+	for name, uri := range c.Sources {
+		check(name != "", "sources: source names must not be empty")
+		check(uri != "", "sources.%s: URI is required", name)
+	}
+	for _, key := range c.SigningKeys {
+		check(key != "", "signingKeys: keys must not be empty")
+	}
+	if err := (&preset.Set{Presets: c.Presets}).Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("presets: %w", err))
+	}
+	check(!c.StrictPresets || len(c.Presets) > 0 || c.PresetFile != "",
+		"strictPresets: requires presets to be defined")
+	check(c.RateLimit.Hits >= 0 && c.RateLimit.Misses >= 0, "rateLimit: rates must not be negative")
+	check(c.RateLimit.HitBurst >= 0 && c.RateLimit.MissBurst >= 0, "rateLimit: bursts must not be negative")
+	if _, err := clientip.New(c.RateLimit.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("rateLimit.trustedProxies: %w", err))
+	}
+	if _, err := c.APIKeySet(); err != nil {
+		errs = append(errs, fmt.Errorf("apiKeys: %w", err))
+	}
+	for _, key := range c.APIKeys {
+		for _, origin := range key.AllowedOrigins {
+			check(origin != "" && !strings.Contains(origin, "/"), "apiKeys.%s.allowedOrigins: %q must be a host name", key.ID, origin)
+		}
+		for _, name := range key.AllowedPresets {
+			// Presets may also come from the preset file, which isn't read here
+			_, ok := c.Presets[name]
+			check(ok || c.PresetFile != "", "apiKeys.%s.allowedPresets: unknown preset %q", key.ID, name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// FetchOptions converts the fetch configuration for the fetch package
+func (c *Config) FetchOptions() fetch.Options {
+	opts := fetch.Options{
+		ConnectTimeout: c.Fetch.ConnectTimeout,
+		ReadTimeout:    c.Fetch.ReadTimeout,
+		Timeout:        c.Fetch.Timeout,
+		Retries:        c.Fetch.Retries,
+		RetryBackoff:   c.Fetch.RetryBackoff,
+		MaxRedirects:   c.Fetch.MaxRedirects,
+		Header:         make(map[string][]string, len(c.Fetch.Headers)),
+	}
+	for name, value := range c.Fetch.Headers {
+		opts.Header.Set(name, value)
+	}
+	return opts
+}
+
+// CORSPolicy converts the CORS configuration for the cors package
+func (c *Config) CORSPolicy() *cors.Policy {
+	return &cors.Policy{
+		AllowedOrigins:   c.CORS.AllowedOrigins,
+		AllowCredentials: c.CORS.AllowCredentials,
+		AllowedHeaders:   c.CORS.AllowedHeaders,
+		ExposedHeaders:   c.CORS.ExposedHeaders,
+		MaxAge:           c.CORS.MaxAge,
+	}
+}
+
+// APIKeySet converts the API keys for the auth package. It returns nil if
+// there are none.
+func (c *Config) APIKeySet() (*auth.Keys, error) {
+	if len(c.APIKeys) == 0 {
+		return nil, nil
+	}
+	keys := make([]auth.Key, len(c.APIKeys))
+	for i, k := range c.APIKeys {
+		keys[i] = auth.Key{
+			ID:             k.ID,
+			Secret:         k.Key,
+			RateLimit:      k.RateLimit,
+			Burst:          k.Burst,
+			AllowedOrigins: k.AllowedOrigins,
+			AllowedPresets: k.AllowedPresets,
+		}
+	}
+	return auth.New(keys)
+}
+
+// ValidateLimits converts the request limits for the validate package
+func (c *Config) ValidateLimits() validate.Limits {
+	return validate.Limits{
+		MaxWidth:  c.Limits.MaxWidth,
+		MaxHeight: c.Limits.MaxHeight,
+	}
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
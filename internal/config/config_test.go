@@ -0,0 +1,164 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/preset"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+listen: ":9000"
+cache: memory:200:1h
+limits:
+  maxWidth: 4000
+quality:
+  webp: 70
+avifSpeed: 6
+allowedOrigins: [images.example.com]
+sources:
+  local: /mnt/originals
+presets:
+  card: {w: 400, h: 300, fit: cover, fmt: webp}
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OPENIMG_MAX_HEIGHT", "3000")
+	t.Setenv("OPENIMG_QUALITY_AVIF", "60")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":9000" || cfg.Cache != "memory:200:1h" || cfg.AVIFSpeed != 6 {
+		t.Errorf("Load() did not apply file values: %+v", cfg)
+	}
+	if cfg.Limits.MaxWidth != 4000 || cfg.Limits.MaxHeight != 3000 {
+		t.Errorf("Load() limits = %+v, want 4000x3000", cfg.Limits)
+	}
+	// Defaults not mentioned in the file are kept
+	if cfg.Limits.MaxPixels != Default().Limits.MaxPixels || cfg.SourceCacheTTL != 10*time.Minute {
+		t.Errorf("Load() lost defaults: %+v", cfg)
+	}
+	if cfg.Quality["webp"] != 70 || cfg.Quality["avif"] != 60 || cfg.Quality["jpeg"] != 85 {
+		t.Errorf("Load() quality = %v", cfg.Quality)
+	}
+	if cfg.Sources["local"] != "/mnt/originals" || cfg.Presets["card"].Width != 400 {
+		t.Errorf("Load() sources = %v, presets = %v", cfg.Sources, cfg.Presets)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"listen": ":9001", "limits": {"maxPixels": 1000}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":9001" || cfg.Limits.MaxPixels != 1000 {
+		t.Errorf("Load() = %+v", cfg)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"PORT":                      "3000",
+		"OPENIMG_CACHE":             "/tmp/cache",
+		"OPENIMG_SOURCE_CACHE_TTL":  "1m",
+		"OPENIMG_MAX_SOURCE_BYTES":  "1024",
+		"OPENIMG_ALLOWED_ORIGINS":   "a.example.com, b.example.com",
+		"OPENIMG_SIGNING_KEYS":      "new,old",
+		"OPENIMG_SHUTDOWN_TIMEOUT":  "5s",
+		"OPENIMG_RATE_LIMIT_MISSES": "0.5",
+	}
+	cfg := Default()
+	if err := cfg.applyEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":3000" || cfg.Cache != "/tmp/cache" || cfg.SourceCacheTTL != time.Minute {
+		t.Errorf("applyEnv() = %+v", cfg)
+	}
+	if cfg.Limits.MaxSourceBytes != 1024 {
+		t.Errorf("applyEnv() max source bytes = %d, want 1024", cfg.Limits.MaxSourceBytes)
+	}
+	if strings.Join(cfg.AllowedOrigins, ";") != "a.example.com;b.example.com" {
+		t.Errorf("applyEnv() allowed origins = %v", cfg.AllowedOrigins)
+	}
+	if strings.Join(cfg.SigningKeys, ";") != "new;old" {
+		t.Errorf("applyEnv() signing keys = %v", cfg.SigningKeys)
+	}
+	if cfg.Server.ShutdownTimeout != 5*time.Second {
+		t.Errorf("applyEnv() shutdown timeout = %v, want 5s", cfg.Server.ShutdownTimeout)
+	}
+	if cfg.RateLimit.Misses != 0.5 {
+		t.Errorf("applyEnv() rate limit misses = %v, want 0.5", cfg.RateLimit.Misses)
+	}
+
+	env = map[string]string{"OPENIMG_MAX_WIDTH": "wide", "OPENIMG_SOURCE_CACHE_TTL": "soon"}
+	err := Default().applyEnv(func(name string) string { return env[name] })
+	if err == nil || !strings.Contains(err.Error(), "OPENIMG_MAX_WIDTH") || !strings.Contains(err.Error(), "OPENIMG_SOURCE_CACHE_TTL") {
+		t.Errorf("applyEnv() error = %v, want errors for both variables", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"empty listen", func(c *Config) { c.Listen = "" }, "listen"},
+		{"zero max width", func(c *Config) { c.Limits.MaxWidth = 0 }, "limits.maxWidth"},
+		{"negative max pixels", func(c *Config) { c.Limits.MaxPixels = -1 }, "limits.maxPixels"},
+		{"quality out of range", func(c *Config) { c.Quality["webp"] = 101 }, "quality.webp"},
+		{"png quality", func(c *Config) { c.Quality["png"] = 80 }, "quality.png"},
+		{"jpg quality", func(c *Config) { c.Quality["jpg"] = 80 }, "quality.jpg: use jpeg"},
+		{"avif speed", func(c *Config) { c.AVIFSpeed = 11 }, "avifSpeed"},
+		{"origin with scheme", func(c *Config) { c.AllowedOrigins = []string{"https://example.com"} }, "allowedOrigins"},
+		{"negative retries", func(c *Config) { c.Fetch.Retries = -1 }, "fetch.retries"},
+		{"health upstream without scheme", func(c *Config) { c.Health.Upstream = "example.com" }, "health.upstream"},
+		{"empty source", func(c *Config) { c.Sources["local"] = "" }, "sources.local"},
+		{"invalid preset", func(c *Config) { c.Presets = map[string]preset.Preset{"big": {Width: 100000}} }, "presets"},
+		{"strict without presets", func(c *Config) { c.StrictPresets = true }, "strictPresets"},
+		{"negative rate limit", func(c *Config) { c.RateLimit.Misses = -1 }, "rateLimit"},
+		{"trusted proxy host name", func(c *Config) { c.RateLimit.TrustedProxies = []string{"lb.internal"} }, "rateLimit.trustedProxies"},
+		{"short API key", func(c *Config) { c.APIKeys = []APIKey{{ID: "team-a", Key: "short"}} }, "apiKeys"},
+		{"duplicate API key ID", func(c *Config) {
+			c.APIKeys = []APIKey{{ID: "team-a", Key: "0123456789abcdef"}, {ID: "team-a", Key: "fedcba9876543210"}}
+		}, "apiKeys"},
+		{"API key with unknown preset", func(c *Config) {
+			c.APIKeys = []APIKey{{ID: "team-a", Key: "0123456789abcdef", AllowedPresets: []string{"thumb"}}}
+		}, "apiKeys.team-a.allowedPresets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want mention of %q", err, tt.wantErr)
+			}
+		})
+	}
+}
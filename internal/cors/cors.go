@@ -0,0 +1,146 @@
+// Package cors implements cross-origin resource sharing policies
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAllowedHeaders are the request headers allowed when a policy lists
+// none
+var DefaultAllowedHeaders = []string{"Accept", "Content-Type"}
+
+// Policy describes the cross-origin requests a handler allows
+type Policy struct {
+	// Origins allowed access: exact origins such as https://app.example.com,
+	// patterns with a wildcard subdomain such as https://*.example.com, or *
+	// for any origin
+	AllowedOrigins   []string
+	AllowCredentials bool          // Allow requests with cookies or HTTP authentication
+	AllowedHeaders   []string      // Request headers allowed in preflighted requests; nil uses DefaultAllowedHeaders
+	ExposedHeaders   []string      // Response headers readable by scripts, e.g. ETag
+	MaxAge           time.Duration // How long browsers may cache preflight responses; 0 leaves it to the browser
+}
+
+// defaultPolicy is the policy of a nil *Policy
+var defaultPolicy = &Policy{AllowedOrigins: []string{"*"}}
+
+// Validate checks that every allowed origin is *, an origin or an origin
+// pattern
+func (p *Policy) Validate() error {
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("origin %q must be *, scheme://host[:port] or scheme://*.domain", origin)
+		}
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("max age must not be negative")
+	}
+	return nil
+}
+
+// AllowOrigin returns the Access-Control-Allow-Origin value for a request from
+// origin, or "" if the origin is not allowed. With credentials, the origin is
+// echoed rather than *, as browsers require.
+func (p *Policy) AllowOrigin(origin string) string {
+	if p == nil {
+		p = defaultPolicy
+	}
+	for _, allowed := range p.AllowedOrigins {
+		switch {
+		case allowed == "*" && !p.AllowCredentials:
+			return "*"
+		case origin == "" || origin == "null":
+			// Opaque origins are only allowed by *, never echoed
+			continue
+		case allowed == "*", strings.EqualFold(allowed, origin), matchPattern(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// Handle sets the CORS headers of the response to r, a request to a resource
+// supporting methods. It answers preflight requests itself, without calling
+// the rest of the handler, and reports whether r was one.
+func (p *Policy) Handle(w http.ResponseWriter, r *http.Request, methods ...string) (preflight bool) {
+	if p == nil {
+		p = defaultPolicy
+	}
+	h := w.Header()
+	origin := r.Header.Get("Origin")
+	preflight = r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	// Responses depend on the origin unless every origin gets *, so shared
+	// caches must key them by it
+	if !p.anyOrigin() {
+		h.Add("Vary", "Origin")
+	}
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	allowed := p.AllowOrigin(origin)
+	if origin != "" && allowed != "" {
+		h.Set("Access-Control-Allow-Origin", allowed)
+		if p.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight && len(p.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+		}
+	}
+	if !preflight {
+		return false
+	}
+
+	if allowed != "" {
+		headers := p.AllowedHeaders
+		if headers == nil {
+			headers = DefaultAllowedHeaders
+		}
+		if !slices.Contains(methods, http.MethodOptions) {
+			methods = append(slices.Clip(methods), http.MethodOptions)
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(headers) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+		if p.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// anyOrigin reports whether every origin is allowed with *
+func (p *Policy) anyOrigin() bool {
+	return slices.Contains(p.AllowedOrigins, "*") && !p.AllowCredentials
+}
+
+// matchPattern reports whether origin matches a pattern such as
+// https://*.example.com, which matches subdomains at any depth but not
+// example.com itself
+func matchPattern(pattern, origin string) bool {
+	prefix, suffix, ok := strings.Cut(strings.ToLower(pattern), "*")
+	if !ok {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@")
+}
@@ -0,0 +1,121 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicy_Handle(t *testing.T) {
+	restricted := &Policy{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+		ExposedHeaders: []string{"ETag", "X-Request-ID"},
+		MaxAge:         10 * time.Minute,
+	}
+	credentials := &Policy{AllowedOrigins: []string{"*"}, AllowCredentials: true, AllowedHeaders: []string{"Authorization"}}
+
+	tests := []struct {
+		name          string
+		policy        *Policy
+		method        string
+		origin        string
+		requestMethod string // Access-Control-Request-Method
+		wantPreflight bool
+		wantStatus    int
+		want          map[string]string
+	}{
+		{"nil allows any origin", nil, "GET", "https://a.test", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "*", "Vary": "",
+		}},
+		{"exact origin", restricted, "GET", "https://app.example.com", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Expose-Headers": "ETag, X-Request-ID", "Vary": "Origin",
+		}},
+		{"pattern", restricted, "GET", "https://cdn.eu.example.org", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "https://cdn.eu.example.org",
+		}},
+		{"pattern excludes apex", restricted, "GET", "https://example.org", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "", "Vary": "Origin",
+		}},
+		{"pattern excludes other schemes", restricted, "GET", "http://cdn.example.org", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"not allowed", restricted, "GET", "https://evil.example.com", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "", "Access-Control-Expose-Headers": "", "Vary": "Origin",
+		}},
+		{"same origin still varies", restricted, "GET", "", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "", "Vary": "Origin",
+		}},
+		{"preflight", restricted, "OPTIONS", "https://app.example.com", "POST", true, http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":   "https://app.example.com",
+			"Access-Control-Allow-Methods":  "GET, POST, OPTIONS",
+			"Access-Control-Allow-Headers":  "Accept, Content-Type",
+			"Access-Control-Max-Age":        "600",
+			"Access-Control-Expose-Headers": "",
+		}},
+		{"preflight not allowed", restricted, "OPTIONS", "https://evil.example.com", "GET", true, http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+		}},
+		{"plain OPTIONS", restricted, "OPTIONS", "", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Methods": "",
+		}},
+		{"credentials echo origin", credentials, "OPTIONS", "https://a.test", "GET", true, http.StatusNoContent, map[string]string{
+			"Access-Control-Allow-Origin":      "https://a.test",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Headers":     "Authorization",
+		}},
+		{"credentials exclude null", credentials, "GET", "null", "", false, http.StatusOK, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/image", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			w := httptest.NewRecorder()
+
+			if got := tt.policy.Handle(w, r, "GET", "POST"); got != tt.wantPreflight {
+				t.Errorf("Handle() = %v, want %v", got, tt.wantPreflight)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			for name, want := range tt.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{"*", false},
+		{"https://app.example.com", false},
+		{"http://localhost:3000", false},
+		{"https://*.example.com", false},
+		{"app.example.com", true},
+		{"https://app.example.com/", true},
+		{"https://app.example.com/path", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			err := (&Policy{AllowedOrigins: []string{tt.origin}}).Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/requestid"
+)
+
+var (
+	ErrNotFound         = errors.New("upstream image not found")
+	ErrForbidden        = errors.New("upstream denied access to image")
+	ErrTooManyRedirects = errors.New("upstream redirected too many times")
+	ErrNotModified      = errors.New("upstream image not modified")
+)
+
+// StatusError is returned when the upstream answers with an unexpected status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.StatusCode)
+}
+
+// Options configures how images are fetched from upstream servers
+type Options struct {
+	ConnectTimeout time.Duration // Time allowed to establish a connection, including TLS
+	ReadTimeout    time.Duration // Time allowed to wait for response headers
+	Timeout        time.Duration // Time allowed for the whole request, including the body
+	Retries        int           // Retries after a network error or 5xx response
+	RetryBackoff   time.Duration // Delay before the first retry, doubled for each further retry
+	MaxRedirects   int           // Redirects to follow; 0 disables redirects
+	Header         http.Header   // Headers sent with every upstream request
+
+	// Observe, if set, is called after every attempt with its duration and
+	// error, e.g. to record metrics
+	Observe func(elapsed time.Duration, err error)
+}
+
+// DefaultOptions returns the options used when none are configured
+func DefaultOptions() Options {
+	return Options{
+		ConnectTimeout: 5 * time.Second,
+		ReadTimeout:    10 * time.Second,
+		Timeout:        30 * time.Second,
+		Retries:        2,
+		RetryBackoff:   200 * time.Millisecond,
+		MaxRedirects:   5,
+		Header:         http.Header{"User-Agent": {"openimg-go"}},
+	}
+}
+
+// Fetcher fetches images from upstream HTTP servers
+type Fetcher struct {
+	client *http.Client
+	opts   Options
+}
+
+// New creates a Fetcher with its own HTTP client configured from opts
+func New(opts Options) *Fetcher {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = opts.ConnectTimeout
+	transport.ResponseHeaderTimeout = opts.ReadTimeout
+
+	return NewWithClient(&http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+	}, opts)
+}
+
+// NewWithClient creates a Fetcher using client; its redirect policy is
+// replaced according to opts
+func NewWithClient(client *http.Client, opts Options) *Fetcher {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > opts.MaxRedirects {
+			return ErrTooManyRedirects
+		}
+		return nil
+	}
+	return &Fetcher{
+		client: &c,
+		opts:   opts,
+	}
+}
+
+// Get fetches url, retrying network errors and 5xx responses until ctx is
+// done. A non-nil response always has a 2xx status; the caller must close its
+// body.
+func (f *Fetcher) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.Do(req)
+}
+
+// Do sends req like Get, within the request's context. The configured headers
+// are added unless req already sets them, so callers can override headers
+// such as Authorization. The request ID in the context, if any, is passed on.
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	for name, values := range f.opts.Header {
+		if _, ok := req.Header[name]; !ok {
+			req.Header[name] = values
+		}
+	}
+	if id := requestid.FromContext(req.Context()); id != "" && req.Header.Get(requestid.Header) == "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	backoff := f.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := f.do(req)
+		if f.opts.Observe != nil {
+			f.opts.Observe(time.Since(start), err)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= f.opts.Retries || !retryable(err) {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (f *Fetcher) do(req *http.Request) (*http.Response, error) {
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, ErrNotModified
+	case http.StatusNotFound, http.StatusGone:
+		return nil, ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrForbidden
+	default:
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+}
+
+// retryable reports whether a failed attempt may succeed when repeated
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrForbidden) &&
+		!errors.Is(err, ErrTooManyRedirects) && !errors.Is(err, ErrNotModified) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// IsTimeout reports whether err was caused by an upstream timeout
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,170 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/requestid"
+)
+
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.RetryBackoff = time.Millisecond
+	return opts
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int // status returned for each successive attempt
+		wantErr      error
+		wantAttempts int32
+	}{
+		{"ok", []int{200}, nil, 1},
+		{"not found", []int{404}, ErrNotFound, 1},
+		{"forbidden", []int{403}, ErrForbidden, 1},
+		{"retry then ok", []int{503, 502, 200}, nil, 3},
+		{"retries exhausted", []int{500, 500, 500, 500}, &StatusError{StatusCode: 500}, 3},
+		{"client error not retried", []int{400, 200}, &StatusError{StatusCode: 400}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer srv.Close()
+
+			var observed int32
+			opts := testOptions()
+			opts.Observe = func(elapsed time.Duration, err error) {
+				atomic.AddInt32(&observed, 1)
+			}
+			resp, err := New(opts).Get(context.Background(), srv.URL)
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			var statusErr, wantStatusErr *StatusError
+			switch {
+			case errors.As(tt.wantErr, &wantStatusErr):
+				if !errors.As(err, &statusErr) || statusErr.StatusCode != wantStatusErr.StatusCode {
+					t.Errorf("Get() error = %v, want %v", err, tt.wantErr)
+				}
+			case err != tt.wantErr:
+				t.Errorf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Get() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if observed != tt.wantAttempts {
+				t.Errorf("Observe called %d times, want %d", observed, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestGetHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("User-Agent"); got != "openimg-go" {
+			t.Errorf("User-Agent = %q, want %q", got, "openimg-go")
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer token")
+		}
+		if got := r.Header.Get(requestid.Header); got != "req-1" {
+			t.Errorf("%s = %q, want %q", requestid.Header, got, "req-1")
+		}
+	}))
+	defer srv.Close()
+
+	opts := testOptions()
+	opts.Header.Set("Authorization", "Bearer token")
+	resp, err := New(opts).Get(requestid.NewContext(context.Background(), "req-1"), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestGetRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/final" {
+			return
+		}
+		http.Redirect(w, r, "/final", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		maxRedirects int
+		wantErr      error
+	}{
+		{"redirect followed", 1, nil},
+		{"redirects disabled", 0, ErrTooManyRedirects},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.MaxRedirects = tt.maxRedirects
+			resp, err := New(opts).Get(context.Background(), srv.URL + "/start")
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	opts := testOptions()
+	opts.ReadTimeout = 10 * time.Millisecond
+	opts.Retries = 0
+	_, err := New(opts).Get(context.Background(), srv.URL)
+	if !IsTimeout(err) {
+		t.Errorf("Get() error = %v, want a timeout", err)
+	}
+}
+
+func TestGetCanceled(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	opts := testOptions()
+	opts.Retries = 5
+	opts.RetryBackoff = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := New(opts).Get(ctx, srv.URL)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Get() kept retrying for %v after the context was done", elapsed)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("upstream attempts = %d, want 1", n)
+	}
+}
@@ -0,0 +1,345 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/source"
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+// modeBatch is the mode batch requests are logged and counted under
+const modeBatch = "batch"
+
+// maxBatchBodyBytes bounds the JSON list of jobs of a batch request
+const maxBatchBodyBytes = 4 << 20
+
+// batchJob is a job of a batch request
+type batchJob struct {
+	ID      string         `json:"id"`      // Echoed in the result; defaults to the job's index
+	Source  string         `json:"source"`  // Remote URL, or <name>:<path> for a named source
+	Options map[string]any `json:"options"` // Query API parameters, e.g. {"w": 400, "fmt": "webp"}
+}
+
+// batchResult is the outcome of a batch job, written as a line of NDJSON or
+// as a part of a multipart response
+type batchResult struct {
+	ID          string     `json:"id"`
+	Status      int        `json:"status"`
+	ContentType string     `json:"contentType,omitempty"`
+	Data        []byte     `json:"data,omitempty"` // The image, base64-encoded in NDJSON
+	Error       *errorBody `json:"error,omitempty"`
+}
+
+// ServeBatch handles POST /api/batch, which transforms a JSON list of jobs
+// concurrently and streams each result as soon as it is ready, in completion
+// order. Results are written as NDJSON, or as multipart/mixed parts when the
+// client accepts them. Jobs reading the same source share a single fetch.
+func (h *ImageHandler) ServeBatch(w http.ResponseWriter, r *http.Request) {
+	tw, r, done := h.begin(w, r)
+	defer done(params.Request{Mode: modeBatch})
+
+	r, ok := h.checkRequest(tw, r, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	var jobs []batchJob
+	if err := json.NewDecoder(http.MaxBytesReader(tw, r.Body, maxBatchBodyBytes)).Decode(&jobs); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(tw, r, errorf(http.StatusRequestEntityTooLarge, "batch_too_large", "batch exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		writeError(tw, r, errorf(http.StatusBadRequest, "invalid_batch", "batch must be a JSON list of jobs: %v", err))
+		return
+	}
+	if len(jobs) == 0 {
+		writeError(tw, r, errorf(http.StatusBadRequest, "invalid_batch", "batch has no jobs"))
+		return
+	}
+	if h.MaxBatchJobs > 0 && len(jobs) > h.MaxBatchJobs {
+		writeError(tw, r, errorf(http.StatusBadRequest, "too_many_jobs", "batch has %d jobs, the maximum is %d", len(jobs), h.MaxBatchJobs))
+		return
+	}
+
+	write, finish := newBatchWriter(tw, r)
+	results := h.runBatch(r.Context(), jobs)
+	rc := http.NewResponseController(tw)
+	var err error
+	for result := range results {
+		if err != nil {
+			// The client has gone away; runBatch stops with the request context
+			continue
+		}
+		if err = write(result); err == nil {
+			rc.Flush()
+		}
+	}
+	if err == nil {
+		err = finish()
+	}
+	logFrom(r.Context()).err = err
+}
+
+// newBatchWriter writes the response header and returns functions writing
+// each result in the format the client accepts and ending the response
+func newBatchWriter(w http.ResponseWriter, r *http.Request) (write func(batchResult) error, finish func() error) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if strings.Contains(r.Header.Get("Accept"), "multipart/mixed") {
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusOK)
+		return func(result batchResult) error {
+			header := textproto.MIMEHeader{
+				"X-Job-Id": {result.ID},
+				"X-Status": {strconv.Itoa(result.Status)},
+			}
+			body := result.Data
+			if result.Error != nil {
+				header.Set("Content-Type", "application/json")
+				body, _ = json.Marshal(result.Error)
+			} else {
+				header.Set("Content-Type", result.ContentType)
+			}
+			part, err := mw.CreatePart(header)
+			if err != nil {
+				return err
+			}
+			_, err = part.Write(body)
+			return err
+		}, mw.Close
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	return func(result batchResult) error {
+		return enc.Encode(result)
+	}, func() error { return nil }
+}
+
+// runBatch runs jobs on up to BatchWorkers goroutines, sending their
+// results on the returned channel, which is closed once all are done
+func (h *ImageHandler) runBatch(ctx context.Context, jobs []batchJob) <-chan batchResult {
+	reqs := make([]params.Request, len(jobs))
+	refs := make([]sourceRef, len(jobs))
+	errs := make([]error, len(jobs))
+	fetches := &batchFetches{h: h, ctx: ctx, reads: map[string]*batchRead{}}
+	for i, job := range jobs {
+		if job.ID == "" {
+			jobs[i].ID = strconv.Itoa(i)
+		}
+		reqs[i], errs[i] = h.batchRequest(ctx, job)
+		if errs[i] == nil {
+			refs[i], errs[i] = h.resolveSource(jobContext(ctx), reqs[i])
+		}
+		if errs[i] == nil {
+			fetches.add(refs[i].id)
+		}
+	}
+
+	workers := max(min(h.BatchWorkers, len(jobs)), 1)
+	queue := make(chan int)
+	results := make(chan batchResult)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				result := batchResult{ID: jobs[i].ID}
+				err := errs[i]
+				if err == nil {
+					result.Data, result.ContentType, err = h.runBatchJob(jobContext(ctx), reqs[i], refs[i], fetches)
+					fetches.release(refs[i].id)
+				}
+				if err != nil {
+					status, code, message := errorResponse(err)
+					result.Status, result.Error = status, &errorBody{Code: code, Message: message}
+				} else {
+					result.Status = http.StatusOK
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		for i := range jobs {
+			if ctx.Err() != nil {
+				break
+			}
+			queue <- i
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// batchRequest converts a job to the request it stands for, expanding its
+// preset
+func (h *ImageHandler) batchRequest(ctx context.Context, job batchJob) (params.Request, error) {
+	q := url.Values{}
+	for name, value := range job.Options {
+		switch v := value.(type) {
+		case string:
+			q.Set(name, v)
+		case float64:
+			q.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			q.Set(name, strconv.FormatBool(v))
+		default:
+			return params.Request{}, errorf(http.StatusBadRequest, "invalid_batch", "option %q must be a string, number or boolean", name)
+		}
+	}
+	req := params.ParseQuery(q)
+	if req.Mode != params.ModeImage {
+		return params.Request{}, errorf(http.StatusBadRequest, "invalid_batch", "batch jobs can only render images")
+	}
+
+	req.URL, req.Source, req.Path = job.Source, "", ""
+	if name, path, ok := strings.Cut(job.Source, ":"); ok {
+		if _, named := h.Sources[name]; named {
+			req.URL, req.Source, req.Path = "", name, path
+		}
+	}
+
+	if err := h.applyPreset(ctx, &req); err != nil {
+		return params.Request{}, err
+	}
+	return req, nil
+}
+
+// runBatchJob renders the image of a job like serveImage, reading its source
+// through fetches
+func (h *ImageHandler) runBatchJob(ctx context.Context, req params.Request, ref sourceRef, fetches *batchFetches) ([]byte, string, error) {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	opts := req.Options
+	if err := h.limits().ImageOptions(opts.Width, opts.Height, opts.Quality, opts.Format, opts.Fit); err != nil {
+		return nil, "", err
+	}
+	if opts.Quality == 0 && opts.Format != "" {
+		opts.Quality = h.defaultQuality(opts.Format)
+	}
+
+	// The response has started, so a limited job only fails itself. Each job
+	// counts against the API key's rate limit, on top of the batch request.
+	if err := h.limitKey(ctx, nil); err != nil {
+		return nil, "", err
+	}
+	cacheKey := cache.GenerateKey(ref.id, opts.Width, opts.Height, opts.Quality, opts.Format, opts.Fit)
+	if cached, err := h.Cache.Get(ctx, cacheKey); err == nil {
+		if err := h.limitHit(ctx, nil); err != nil {
+			return nil, "", err
+		}
+		data, _ := decodeRendition(cached)
+		return data, contentType(opts.Format), nil
+	}
+	if err := h.limitMiss(ctx, nil); err != nil {
+		return nil, "", err
+	}
+
+	data, info, err := fetches.read(ctx, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	transformed, format, err := h.render(ctx, data, transform.Options{
+		Width:   opts.Width,
+		Height:  opts.Height,
+		Format:  opts.Format,
+		Quality: opts.Quality,
+		Fit:     opts.Fit,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	h.Cache.Set(ctx, cacheKey, encodeRendition(transformed, info))
+	return transformed, contentType(format), nil
+}
+
+// jobContext gives a batch job a request log of its own, since jobs run
+// concurrently and their details don't belong in the batch's access log
+func jobContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{})
+}
+
+// batchFetches shares source reads between the jobs of a batch. Each source
+// is read once, within the batch's context rather than a job's, and its bytes
+// are dropped once every job using it is done.
+type batchFetches struct {
+	h   *ImageHandler
+	ctx context.Context
+
+	mu    sync.Mutex
+	reads map[string]*batchRead
+}
+
+type batchRead struct {
+	users int // Jobs that haven't finished with the source
+	once  sync.Once
+	done  chan struct{}
+	data  []byte
+	info  source.Info
+	err   error
+}
+
+// add registers a job using the source with the given id
+func (f *batchFetches) add(id string) {
+	rd, ok := f.reads[id]
+	if !ok {
+		rd = &batchRead{done: make(chan struct{})}
+		f.reads[id] = rd
+	}
+	rd.users++
+}
+
+// read returns the bytes of a source, reading it if no other job has
+func (f *batchFetches) read(ctx context.Context, ref sourceRef) ([]byte, source.Info, error) {
+	f.mu.Lock()
+	rd := f.reads[ref.id]
+	f.mu.Unlock()
+
+	// The read carries on if this job gives up, as other jobs may need it
+	rd.once.Do(func() {
+		go func() {
+			rd.data, rd.info, rd.err = f.h.readSource(jobContext(f.ctx), ref)
+			close(rd.done)
+		}()
+	})
+	select {
+	case <-rd.done:
+		return rd.data, rd.info, rd.err
+	case <-ctx.Done():
+		return nil, source.Info{}, ctx.Err()
+	}
+}
+
+// release records that a job is done with a source
+func (f *batchFetches) release(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rd := f.reads[id]; rd != nil {
+		if rd.users--; rd.users == 0 {
+			delete(f.reads, id)
+		}
+	}
+}
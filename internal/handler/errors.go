@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/pool"
+	"github.com/deyshin/openimg-go/internal/preset"
+	"github.com/deyshin/openimg-go/internal/requestid"
+	"github.com/deyshin/openimg-go/internal/source"
+	"github.com/deyshin/openimg-go/internal/validate"
+	"github.com/deyshin/openimg-go/pkg/signature"
+)
+
+var (
+	// ErrUnauthorized and ErrForbidden are returned by Authorize hooks to
+	// reject a request with 401 Unauthorized or 403 Forbidden
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// errorBody is the JSON body of an error response
+type errorBody struct {
+	Code      string `json:"code"` // Stable, machine-readable code
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// requestError is a failure with a known status and code
+type requestError struct {
+	status  int
+	code    string
+	message string
+	err     error // Underlying error, logged but not sent to the client
+}
+
+// newRequestError creates a request error whose message is err's
+func newRequestError(status int, code string, err error) *requestError {
+	return &requestError{status: status, code: code, message: err.Error(), err: err}
+}
+
+// errorf creates a request error with a formatted message
+func errorf(status int, code, format string, args ...any) *requestError {
+	return newRequestError(status, code, fmt.Errorf(format, args...))
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// writeError responds to err with a JSON error body. The status and code are
+// derived from err; the underlying error is kept for the access log.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	logFrom(r.Context()).err = err
+	if errors.Is(err, context.Canceled) {
+		// The client has gone away; there is no one to respond to
+		return
+	}
+
+	status, code, message := errorResponse(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: requestid.FromContext(r.Context()),
+	})
+}
+
+// errorResponse maps err to a status, code and client-facing message
+func errorResponse(err error) (int, string, string) {
+	var reqErr *requestError
+	var validateErr *validate.Error
+	switch {
+	case errors.As(err, &reqErr):
+		return reqErr.status, reqErr.code, reqErr.message
+	case errors.As(err, &validateErr):
+		return http.StatusBadRequest, validateErr.Code, validateErr.Message
+
+	// Presets, signatures and authorization
+	case errors.Is(err, preset.ErrUnknown):
+		return http.StatusBadRequest, "unknown_preset", err.Error()
+	case errors.Is(err, preset.ErrRequired):
+		return http.StatusBadRequest, "preset_required", err.Error()
+	case errors.Is(err, preset.ErrOverrideNotAllowed):
+		return http.StatusBadRequest, "override_not_allowed", err.Error()
+	case errors.Is(err, signature.ErrMissing):
+		return http.StatusForbidden, "signature_missing", err.Error()
+	case errors.Is(err, signature.ErrExpired):
+		return http.StatusForbidden, "signature_expired", err.Error()
+	case errors.Is(err, signature.ErrInvalid):
+		return http.StatusForbidden, "signature_invalid", err.Error()
+	case errors.Is(err, auth.ErrMissingKey):
+		return http.StatusUnauthorized, "missing_api_key", err.Error()
+	case errors.Is(err, auth.ErrInvalidKey):
+		return http.StatusUnauthorized, "invalid_api_key", err.Error()
+	case errors.Is(err, auth.ErrRateLimited), errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests, "rate_limited", err.Error()
+	case errors.Is(err, auth.ErrPresetNotAllowed):
+		return http.StatusForbidden, "preset_not_allowed", err.Error()
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, "forbidden", err.Error()
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, "unauthorized", err.Error()
+
+	// Loading and processing the original image
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout", "Timed out processing image"
+	case errors.Is(err, pool.ErrBusy):
+		return http.StatusServiceUnavailable, "server_busy", "Server busy, try again later"
+	case errors.Is(err, errTransform):
+		return http.StatusInternalServerError, "transform_failed", "Failed to transform image"
+	case errors.Is(err, errSourceTooLarge):
+		return http.StatusRequestEntityTooLarge, "source_too_large", errSourceTooLarge.Error()
+	case errors.Is(err, errTooManyPixels):
+		return http.StatusUnprocessableEntity, "too_many_pixels", errTooManyPixels.Error()
+	case errors.Is(err, errDecode):
+		return http.StatusBadGateway, "decode_failed", "Failed to decode image"
+	case errors.Is(err, source.ErrInvalidPath):
+		return http.StatusBadRequest, "invalid_path", source.ErrInvalidPath.Error()
+	case errors.Is(err, source.ErrNotFound):
+		return http.StatusNotFound, "upstream_not_found", source.ErrNotFound.Error()
+	case errors.Is(err, source.ErrForbidden):
+		return http.StatusForbidden, "upstream_forbidden", source.ErrForbidden.Error()
+	case fetch.IsTimeout(err):
+		return http.StatusGatewayTimeout, "upstream_timeout", "Timed out fetching image"
+	default:
+		return http.StatusBadGateway, "upstream_error", "Failed to fetch image"
+	}
+}
@@ -0,0 +1,498 @@
+// Package handler implements the openimg-go HTTP API: the query and path
+// image APIs, batch and picture requests, and health checks
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/cors"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/metadata"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/pool"
+	"github.com/deyshin/openimg-go/internal/preset"
+	"github.com/deyshin/openimg-go/internal/source"
+	"github.com/deyshin/openimg-go/internal/transform"
+	"github.com/deyshin/openimg-go/internal/validate"
+	"github.com/deyshin/openimg-go/pkg/signature"
+)
+
+type ImageHandler struct {
+	Fetcher        *fetch.Fetcher
+	Sources        map[string]source.Source // Named sources selected with the src parameter
+	SourceCache    *source.Cache            // Cache of original image bytes; nil disables it
+	Presets        *preset.Set              // Named transformation presets; nil disables them
+	Cache          cache.Cache
+	Verifier       *signature.Verifier // nil disables URL signing
+	Signer         *signature.Signer   // Signs generated URLs; nil leaves them unsigned
+	PublicURL      string              // Base of generated URLs, e.g. https://img.example.com; empty makes them root-relative
+	Pool           *pool.Pool          // Limits concurrent image processing; nil means no limit
+	Timeout        time.Duration       // Deadline for serving a request; 0 means none
+	Metrics        *Metrics            // nil disables metrics
+	Logger         *slog.Logger        // Access log; nil uses slog.Default()
+	Limits         validate.Limits     // Output dimension limits; zero uses validate.DefaultLimits
+	MaxSourceBytes int64               // Maximum size of a source image; 0 means no limit
+	MaxUploadBytes int64               // Maximum size of an uploaded image; 0 means no limit
+	MaxBatchJobs   int                 // Maximum jobs in a batch request; 0 means no limit
+	BatchWorkers   int                 // Jobs of a batch request run at once; 0 runs them one at a time
+	MaxPixels      int64               // Maximum width*height of a source image; 0 means no limit
+	Quality        map[string]int      // Default quality per output format
+	AVIFSpeed      int                 // AVIF encoder speed; 0 uses the encoder's default
+	AllowedOrigins []string            // Hosts remote images may be fetched from; empty allows all
+	CORS           *cors.Policy        // Cross-origin access policy; nil allows any origin
+	HealthUpstream string              // URL fetched by readiness checks; empty skips the check
+	HealthTimeout  time.Duration       // Deadline for each readiness check; 0 means none
+	Prefix         string              // Path the API is mounted under, e.g. /media; generated URLs include it
+	APIKeys        *auth.Keys          // Keys clients must authenticate with; nil disables API keys
+	RateLimits     *RateLimits         // Per-client rate limits; nil disables them
+
+	// Authorize, if set, is called for every request once its method and
+	// signature are checked. Returning an error rejects the request with 401
+	// Unauthorized, or 403 Forbidden if it wraps ErrForbidden.
+	Authorize func(r *http.Request) error
+	// OnRequest, if set, is called after every request is served
+	OnRequest func(ctx context.Context, info RequestInfo)
+}
+
+// Register adds the image API routes to mux, under Prefix
+func (h *ImageHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(h.Prefix+"/api/image", h.ServeImage)
+	mux.HandleFunc(h.Prefix+"/api/batch", h.ServeBatch)
+	mux.HandleFunc(h.Prefix+"/api/picture", h.ServePicture)
+	mux.Handle(h.Prefix+"/img/", http.StripPrefix(h.Prefix+"/img", http.HandlerFunc(h.ServePath)))
+}
+
+// Close flushes the handler's caches
+func (h *ImageHandler) Close() error {
+	errs := []error{cache.Close(h.Cache)}
+	if h.SourceCache != nil {
+		errs = append(errs, h.SourceCache.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ServeImage handles query API requests such as /api/image?url=...&w=400
+func (h *ImageHandler) ServeImage(w http.ResponseWriter, r *http.Request) {
+	tw, r, done := h.begin(w, r)
+	req := params.ParseQuery(r.URL.Query())
+	defer func() { done(req) }()
+
+	r, ok := h.checkRequest(tw, r, http.MethodGet, http.MethodPost)
+	if !ok {
+		return
+	}
+	h.serve(tw, r, req)
+}
+
+// ServePath handles path API requests such as /img/w_400,f_webp/<source>.
+// It must be mounted with the route prefix stripped, e.g. with http.StripPrefix.
+func (h *ImageHandler) ServePath(w http.ResponseWriter, r *http.Request) {
+	tw, r, done := h.begin(w, r)
+	var req params.Request
+	defer func() { done(req) }()
+
+	r, ok := h.checkRequest(tw, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	var err error
+	if req, err = params.ParsePath(r.URL.EscapedPath()); err != nil {
+		writeError(tw, r, newRequestError(http.StatusBadRequest, "invalid_path", err))
+		return
+	}
+	h.serve(tw, r, req)
+}
+
+// checkRequest sets the CORS headers and checks the method, signature,
+// credentials and rate limits of a request, reporting whether it should be
+// served. The returned request carries the request's API key and client. OPTIONS is allowed
+// in addition to methods; CORS preflights are answered before any other
+// check, as browsers send them without credentials.
+func (h *ImageHandler) checkRequest(w http.ResponseWriter, r *http.Request, methods ...string) (*http.Request, bool) {
+	if h.corsPolicy().Handle(w, r, methods...) {
+		return r, false
+	}
+
+	allow := strings.Join(append(methods, http.MethodOptions), ", ")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+		return r, false
+	}
+
+	if !slices.Contains(methods, r.Method) {
+		w.Header().Set("Allow", allow)
+		writeError(w, r, errorf(http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed"))
+		return r, false
+	}
+
+	// Reject unsigned or tampered requests before doing any work. The
+	// signature covers the URL as requested, before any prefix was stripped.
+	if h.Verifier != nil {
+		u, err := url.ParseRequestURI(r.RequestURI)
+		if err != nil {
+			u = r.URL
+		}
+		if err := h.Verifier.Verify(u); err != nil {
+			writeError(w, r, err)
+			return r, false
+		}
+	}
+
+	// A valid signature is a credential of its own: signed URLs such as the
+	// renditions in picture markup are loaded by browsers, which can't send
+	// keys. Signed requests that do carry a key are still charged to it.
+	if h.APIKeys != nil && (h.Verifier == nil || auth.FromRequest(r) != "") {
+		key, err := h.APIKeys.Authenticate(r)
+		if err != nil {
+			writeError(w, r, err)
+			return r, false
+		}
+		logFrom(r.Context()).key = key.ID
+		r = r.WithContext(auth.NewContext(r.Context(), key))
+		if err := h.limitKey(r.Context(), w.Header()); err != nil {
+			writeError(w, r, err)
+			return r, false
+		}
+	}
+
+	r = h.identifyClient(r)
+
+	if h.Authorize != nil {
+		if err := h.Authorize(r); err != nil {
+			if !errors.Is(err, ErrForbidden) && !errors.Is(err, ErrUnauthorized) {
+				err = newRequestError(http.StatusUnauthorized, "unauthorized", err)
+			}
+			writeError(w, r, err)
+			return r, false
+		}
+	}
+	return r, true
+}
+
+// corsPolicy returns the CORS policy. When API keys are required and the
+// policy doesn't list its allowed headers, the headers keys are sent in are
+// allowed too, so browsers can send them.
+func (h *ImageHandler) corsPolicy() *cors.Policy {
+	if h.APIKeys == nil || (h.CORS != nil && h.CORS.AllowedHeaders != nil) {
+		return h.CORS
+	}
+	p := cors.Policy{AllowedOrigins: []string{"*"}}
+	if h.CORS != nil {
+		p = *h.CORS
+	}
+	p.AllowedHeaders = append(slices.Clip(cors.DefaultAllowedHeaders), auth.Header, "Authorization")
+	return &p
+}
+
+// applyPreset expands the preset of req, checking that the request's API key
+// allows it
+func (h *ImageHandler) applyPreset(ctx context.Context, req *params.Request) error {
+	if err := auth.FromContext(ctx).AllowPreset(req.Preset); err != nil {
+		return err
+	}
+	if h.Presets != nil {
+		return h.Presets.Apply(req)
+	}
+	if req.Preset != "" {
+		return fmt.Errorf("%w %q", preset.ErrUnknown, req.Preset)
+	}
+	return nil
+}
+
+func (h *ImageHandler) limits() validate.Limits {
+	if h.Limits == (validate.Limits{}) {
+		return validate.DefaultLimits
+	}
+	return h.Limits
+}
+
+// defaultQuality returns the quality used for format when none is requested
+func (h *ImageHandler) defaultQuality(format string) int {
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if q, ok := h.Quality[format]; ok {
+		return q
+	}
+	return 85
+}
+
+func (h *ImageHandler) serve(w http.ResponseWriter, r *http.Request, req params.Request) {
+	// Everything below stops when the client goes away or the deadline passes
+	if h.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Expand presets before anything else, so preset and explicit requests
+	// share cache keys
+	if err := h.applyPreset(r.Context(), &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		h.serveUpload(w, r, req)
+		return
+	}
+
+	switch req.Mode {
+	case params.ModeMetadata:
+		h.serveMetadata(w, r, req)
+	case params.ModePlaceholder:
+		h.servePlaceholder(w, r, req)
+	default:
+		h.serveImage(w, r, req)
+	}
+}
+
+func (h *ImageHandler) serveImage(w http.ResponseWriter, r *http.Request, req params.Request) {
+	ctx := r.Context()
+
+	// Get source image and transformation parameters
+	ref, err := h.resolveSource(r.Context(), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	width := req.Options.Width
+	height := req.Options.Height
+	quality := req.Options.Quality
+	format := req.Options.Format
+	fit := req.Options.Fit
+
+	if err := h.limits().ImageOptions(width, height, quality, format, fit); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Use the default quality for the output format, when it is known
+	if quality == 0 && format != "" {
+		quality = h.defaultQuality(format)
+	}
+
+	// Generate cache key
+	cacheKey := cache.GenerateKey(ref.id, width, height, quality, format, fit)
+
+	// Try to get from cache
+	if cached, err := h.Cache.Get(ctx, cacheKey); err == nil {
+		logFrom(ctx).cache = "hit"
+		if err := h.limitHit(ctx, w.Header()); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		data, info := decodeRendition(cached)
+		if checkNotModified(w, r, info, cacheKey) {
+			return
+		}
+		w.Header().Set("Content-Type", contentType(format))
+		w.Write(data)
+		return
+	}
+
+	logFrom(ctx).cache = "miss"
+	if err := h.limitMiss(ctx, w.Header()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Fetch the image
+	data, info, err := h.readSource(ctx, ref)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if checkNotModified(w, r, info, cacheKey) {
+		return
+	}
+
+	// Decode and transform the image
+	transformed, format, err := h.render(ctx, data, transform.Options{
+		Width:   width,
+		Height:  height,
+		Format:  format,
+		Quality: quality,
+		Fit:     fit,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Store in cache, with the source's validators for conditional requests
+	h.Cache.Set(ctx, cacheKey, encodeRendition(transformed, info))
+
+	w.Header().Set("Content-Type", contentType(format))
+	w.Write(transformed)
+}
+
+// render decodes data and transforms it in the worker pool, returning the
+// encoded image and its format. Without a format, the source's format is
+// kept; without a quality, the format's default is used.
+func (h *ImageHandler) render(ctx context.Context, data []byte, opts transform.Options) ([]byte, string, error) {
+	var transformed []byte
+	err := h.process(ctx, func() error {
+		img, imgFormat, err := h.decode(ctx, data)
+		if err != nil {
+			return err
+		}
+
+		// If format is not specified, use original format
+		if opts.Format == "" {
+			opts.Format = imgFormat
+		}
+		if opts.Quality == 0 {
+			opts.Quality = h.defaultQuality(opts.Format)
+		}
+		opts.Speed = h.AVIFSpeed
+
+		start := time.Now()
+		transformed, err = transform.TransformContext(ctx, img, opts)
+		logFrom(ctx).stage("encode", start)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %w", errTransform, err)
+		}
+		h.Metrics.observeEncode(opts.Format, time.Since(start))
+		return nil
+	})
+	return transformed, opts.Format, err
+}
+
+// contentType returns the media type of an output format
+func contentType(format string) string {
+	switch format {
+	case "jpg", "jpeg":
+		return "image/jpeg"
+	case "avif":
+		return "image/avif"
+	case "webp":
+		return "image/webp"
+	default:
+		return "image/png"
+	}
+}
+
+func (h *ImageHandler) serveMetadata(w http.ResponseWriter, r *http.Request, req params.Request) {
+	ref, err := h.resolveSource(r.Context(), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Metadata isn't cached, so every request reads the original
+	if err := h.limitMiss(r.Context(), w.Header()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	obj, err := h.openSource(r.Context(), ref)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer obj.Body.Close()
+
+	meta, err := metadata.Get(obj.Body)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: %w", errDecode, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+func (h *ImageHandler) servePlaceholder(w http.ResponseWriter, r *http.Request, req params.Request) {
+	ctx := r.Context()
+
+	ref, err := h.resolveSource(r.Context(), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Placeholder options
+	width := req.Options.Width
+	height := req.Options.Height
+	quality := req.Options.Quality
+
+	// Generate cache key for placeholder
+	cacheKey := cache.GenerateKey(ref.id, width, height, quality, "placeholder", "")
+
+	// Try to get from cache
+	if cached, err := h.Cache.Get(ctx, cacheKey); err == nil {
+		logFrom(ctx).cache = "hit"
+		if err := h.limitHit(ctx, w.Header()); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(cached)
+		return
+	}
+
+	logFrom(ctx).cache = "miss"
+	if err := h.limitMiss(ctx, w.Header()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Fetch the image
+	data, _, err := h.readSource(ctx, ref)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Decode the image and generate the placeholder
+	placeholder, err := h.placeholder(ctx, data, transform.PlaceholderOptions{
+		Width:   width,
+		Height:  height,
+		Quality: quality,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Store in cache
+	h.Cache.Set(ctx, cacheKey, []byte(placeholder))
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(placeholder))
+}
+
+// placeholder decodes data and generates its placeholder in the worker pool
+func (h *ImageHandler) placeholder(ctx context.Context, data []byte, opts transform.PlaceholderOptions) (string, error) {
+	var placeholder string
+	err := h.process(ctx, func() error {
+		img, _, err := h.decode(ctx, data)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		placeholder, err = transform.GeneratePlaceholder(img, opts)
+		logFrom(ctx).stage("encode", start)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errTransform, err)
+		}
+		return nil
+	})
+	return placeholder, err
+}
@@ -0,0 +1,1589 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/clientip"
+	"github.com/deyshin/openimg-go/internal/cors"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/pool"
+	"github.com/deyshin/openimg-go/internal/preset"
+	"github.com/deyshin/openimg-go/internal/ratelimit"
+	"github.com/deyshin/openimg-go/internal/requestid"
+	"github.com/deyshin/openimg-go/internal/source"
+	"github.com/deyshin/openimg-go/internal/transform"
+	"github.com/deyshin/openimg-go/internal/validate"
+	"github.com/deyshin/openimg-go/pkg/signature"
+)
+
+func TestImageHandler_ServeImage(t *testing.T) {
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewMemoryCache(100, time.Hour),
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{
+			name:       "valid request",
+			url:        "/api/image?url=https://picsum.photos/800/600&w=200&h=200",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing url",
+			url:        "/api/image?w=200&h=200",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid dimensions",
+			url:        "/api/image?url=https://picsum.photos/800/600&w=5000",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid quality",
+			url:        "/api/image?url=https://picsum.photos/800/600&q=101",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid format",
+			url:        "/api/image?url=https://picsum.photos/800/600&fmt=gif",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid fit",
+			url:        "/api/image?url=https://picsum.photos/800/600&fit=stretch",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestImageHandler_MethodNotAllowed(t *testing.T) {
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewMemoryCache(100, time.Hour),
+	}
+
+	methods := []string{"PUT", "DELETE", "PATCH"}
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			req := httptest.NewRequest(method, "/api/image", nil)
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+			}
+		})
+	}
+
+	// Uploads are only accepted by the query API
+	w := httptest.NewRecorder()
+	handler.ServePath(w, httptest.NewRequest("POST", "/-/a.png", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("ServePath() POST status = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestImageHandler_SignedURLs(t *testing.T) {
+	handler := &ImageHandler{
+		Fetcher:  fetch.New(fetch.DefaultOptions()),
+		Cache:    cache.NewMemoryCache(100, time.Hour),
+		Verifier: signature.NewVerifier([]byte("secret")),
+	}
+	signer := signature.NewSigner([]byte("secret"))
+
+	// Invalid options still fail validation once the signature is accepted,
+	// which shows the signature check passed without fetching anything
+	signed, _ := signer.SignURL("/api/image?url=https://example.com/a.jpg&w=5000", time.Time{})
+	expired, _ := signer.SignURL("/api/image?url=https://example.com/a.jpg&w=5000", time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{"unsigned", "/api/image?url=https://example.com/a.jpg&w=5000", http.StatusForbidden},
+		{"signed", signed, http.StatusBadRequest},
+		{"tampered", signed + "&h=10", http.StatusForbidden},
+		{"expired", expired, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestImageHandler_SourceLimits(t *testing.T) {
+	data := newTestOrigin(t, 100, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name           string
+		maxSourceBytes int64
+		maxPixels      int64
+		wantStatus     int
+	}{
+		{"within limits", 0, 0, http.StatusOK},
+		{"source too large", int64(len(data) - 1), 0, http.StatusRequestEntityTooLarge},
+		{"too many pixels", 0, 100*100 - 1, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &ImageHandler{
+				Fetcher:        fetch.New(fetch.DefaultOptions()),
+				Cache:          cache.NewNoopCache(),
+				MaxSourceBytes: tt.maxSourceBytes,
+				MaxPixels:      tt.maxPixels,
+			}
+			req := httptest.NewRequest("GET", "/api/image?fmt=png&url="+origin.URL+"/a.png", nil)
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestImageHandler_UpstreamStatus(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.png":
+			http.NotFound(w, r)
+		case "/private.png":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer origin.Close()
+
+	opts := fetch.DefaultOptions()
+	opts.Retries = 0
+	handler := &ImageHandler{
+		Fetcher: fetch.New(opts),
+		Cache:   cache.NewNoopCache(),
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{"not found", "/api/image?url=" + origin.URL + "/missing.png", http.StatusNotFound},
+		{"forbidden", "/api/image?url=" + origin.URL + "/private.png", http.StatusForbidden},
+		{"server error", "/api/image?url=" + origin.URL + "/broken.png", http.StatusBadGateway},
+		{"metadata not found", "/api/image?metadata=true&url=" + origin.URL + "/missing.png", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestImageHandler_LocalSource(t *testing.T) {
+	dir := t.TempDir()
+	data := newTestOrigin(t, 10, 10)
+	if err := os.MkdirAll(filepath.Join(dir, "products"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "products", "a.png"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "products", "a.png"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := source.NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Sources: map[string]source.Source{"local": local},
+		Cache:   cache.NewNoopCache(),
+	}
+
+	tests := []struct {
+		name            string
+		url             string
+		ifModifiedSince string
+		wantStatus      int
+	}{
+		{"image", "/api/image?src=local&path=products/a.png&w=5", "", http.StatusOK},
+		{"metadata", "/api/image?src=local&path=products/a.png&metadata=true", "", http.StatusOK},
+		{"placeholder", "/api/image?src=local&path=products/a.png&placeholder=true", "", http.StatusOK},
+		{"not modified", "/api/image?src=local&path=products/a.png&w=5", mtime.Format(http.TimeFormat), http.StatusNotModified},
+		{"modified", "/api/image?src=local&path=products/a.png&w=5", mtime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+		{"missing file", "/api/image?src=local&path=products/b.png", "", http.StatusNotFound},
+		{"path traversal", "/api/image?src=local&path=../etc/passwd", "", http.StatusBadRequest},
+		{"missing path", "/api/image?src=local", "", http.StatusBadRequest},
+		{"unknown source", "/api/image?src=other&path=products/a.png", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.ifModifiedSince != "" {
+				req.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/image?src=local&path=products/a.png", nil)
+	w := httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if got := w.Header().Get("Last-Modified"); got != mtime.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q, want %q", got, mtime.Format(http.TimeFormat))
+	}
+}
+
+func TestImageHandler_S3Source(t *testing.T) {
+	data := newTestOrigin(t, 10, 10)
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/originals/a.png" {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	}))
+	defer bucket.Close()
+
+	fetcher := fetch.New(fetch.DefaultOptions())
+	s3, err := source.NewS3(source.S3Config{
+		Bucket:          "images",
+		Prefix:          "originals",
+		Endpoint:        bucket.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	}, fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &ImageHandler{
+		Fetcher: fetcher,
+		Sources: map[string]source.Source{"assets": s3},
+		Cache:   cache.NewNoopCache(),
+	}
+
+	req := httptest.NewRequest("GET", "/api/image?src=assets&path=a.png&w=5", nil)
+	w := httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ServeImage() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("ServeImage() did not set an ETag")
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"matching etag", "/api/image?src=assets&path=a.png&w=5", etag, http.StatusNotModified},
+		{"other rendition", "/api/image?src=assets&path=a.png&w=6", etag, http.StatusOK},
+		{"stale etag", "/api/image?src=assets&path=a.png&w=5", `"old"`, http.StatusOK},
+		{"missing object", "/api/image?src=assets&path=b.png", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	t.Run("cache hit", func(t *testing.T) {
+		handler.Cache = cache.NewMemoryCache(10, time.Hour)
+		defer func() { handler.Cache = cache.NewNoopCache() }()
+
+		for _, ifNoneMatch := range []string{"", "", etag} {
+			req := httptest.NewRequest("GET", "/api/image?src=assets&path=a.png&w=5", nil)
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			want := http.StatusOK
+			if ifNoneMatch != "" {
+				want = http.StatusNotModified
+			}
+			if w.Code != want || w.Header().Get("ETag") != etag {
+				t.Errorf("ServeImage(If-None-Match: %q) = %v with ETag %q, want %v with %q", ifNoneMatch, w.Code, w.Header().Get("ETag"), want, etag)
+			}
+			if w.Code == http.StatusOK && !bytes.HasPrefix(w.Body.Bytes(), []byte("\x89PNG")) {
+				t.Errorf("ServeImage() body = %.20q, want a PNG", w.Body.Bytes())
+			}
+		}
+	})
+}
+
+func TestImageHandler_SourceCache(t *testing.T) {
+	data := newTestOrigin(t, 100, 100)
+	var fetches int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	handler := &ImageHandler{
+		Fetcher:     fetch.New(fetch.DefaultOptions()),
+		Cache:       cache.NewMemoryCache(10, time.Hour),
+		SourceCache: source.NewCache(cache.NewMemoryCache(10, 0), time.Hour, 0),
+	}
+
+	for width := 10; width <= 100; width += 10 {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/image?url=%s/a.png&w=%d", origin.URL, width), nil)
+		w := httptest.NewRecorder()
+		handler.ServeImage(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("ServeImage() status = %v, want %v", w.Code, http.StatusOK)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("origin fetched %d times, want 1", fetches)
+	}
+}
+
+func TestImageHandler_ServePath(t *testing.T) {
+	data := newTestOrigin(t, 100, 100)
+	var fetches int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewMemoryCache(10, time.Hour),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/image", handler.ServeImage)
+	mux.Handle("/img/", http.StripPrefix("/img", http.HandlerFunc(handler.ServePath)))
+
+	imageURL := origin.URL + "/a.png"
+	encoded := params.Request{URL: imageURL, Options: transform.Options{Width: 40, Format: "png"}}.EncodePath()
+
+	tests := []struct {
+		name        string
+		url         string
+		wantStatus  int
+		wantFetches int
+	}{
+		{"base64url source", "/img/" + encoded, http.StatusOK, 1},
+		{"equivalent query", "/api/image?fmt=png&w=40&url=" + url.QueryEscape(imageURL), http.StatusOK, 1},
+		{"escaped source", "/img/f_png,w_40/" + url.PathEscape(imageURL), http.StatusOK, 1},
+		{"different options", "/img/f_png,w_50/" + url.PathEscape(imageURL), http.StatusOK, 2},
+		{"metadata", "/img/metadata/" + url.PathEscape(imageURL), http.StatusOK, 3},
+		{"invalid options", "/img/w_abc/" + url.PathEscape(imageURL), http.StatusBadRequest, 3},
+		{"invalid dimensions", "/img/w_5000/" + url.PathEscape(imageURL), http.StatusBadRequest, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if fetches != tt.wantFetches {
+				t.Errorf("origin fetched %d times, want %d", fetches, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestImageHandler_SignedPath(t *testing.T) {
+	handler := &ImageHandler{
+		Fetcher:  fetch.New(fetch.DefaultOptions()),
+		Cache:    cache.NewNoopCache(),
+		Verifier: signature.NewVerifier([]byte("secret")),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/img/", http.StripPrefix("/img", http.HandlerFunc(handler.ServePath)))
+
+	// The dimensions are invalid, so a request passing the signature check
+	// fails validation without fetching anything
+	path := "/img/w_5000/" + url.PathEscape("https://example.com/a.jpg")
+	signed, _ := signature.NewSigner([]byte("secret")).SignURL(path, time.Time{})
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{"unsigned", path, http.StatusForbidden},
+		{"signed", signed, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestImageHandler_Presets(t *testing.T) {
+	data := newTestOrigin(t, 100, 100)
+	var fetches int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewMemoryCache(10, time.Hour),
+		Presets: &preset.Set{
+			Strict: true,
+			Presets: map[string]preset.Preset{
+				"card": {Width: 40, Height: 30, Fit: "cover", Format: "png", Override: []string{"q"}},
+			},
+		},
+	}
+	imageURL := url.QueryEscape(origin.URL + "/a.png")
+
+	tests := []struct {
+		name        string
+		url         string
+		wantStatus  int
+		wantFetches int
+	}{
+		{"preset", "/api/image?preset=card&url=" + imageURL, http.StatusOK, 1},
+		{"preset in path", "/img/p_card/" + imageURL, http.StatusOK, 1},
+		{"allowed override", "/api/image?preset=card&q=50&url=" + imageURL, http.StatusOK, 2},
+		{"disallowed override", "/api/image?preset=card&w=80&url=" + imageURL, http.StatusBadRequest, 2},
+		{"unknown preset", "/api/image?preset=hero&url=" + imageURL, http.StatusBadRequest, 2},
+		{"strict mode", "/api/image?w=40&url=" + imageURL, http.StatusBadRequest, 2},
+		{"metadata in strict mode", "/api/image?metadata=true&url=" + imageURL, http.StatusOK, 3},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/image", handler.ServeImage)
+	mux.Handle("/img/", http.StripPrefix("/img", http.HandlerFunc(handler.ServePath)))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if fetches != tt.wantFetches {
+				t.Errorf("origin fetched %d times, want %d", fetches, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestImageHandler_Config(t *testing.T) {
+	data := newTestOrigin(t, 100, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	handler := &ImageHandler{
+		Fetcher:        fetch.New(fetch.DefaultOptions()),
+		Cache:          cache.NewNoopCache(),
+		Limits:         validate.Limits{MaxWidth: 50, MaxHeight: 50},
+		AllowedOrigins: []string{originURL.Hostname()},
+		CORS:           &cors.Policy{AllowedOrigins: []string{"https://app.example.com"}},
+	}
+	imageURL := url.QueryEscape(origin.URL + "/a.png")
+
+	tests := []struct {
+		name       string
+		url        string
+		origin     string
+		wantStatus int
+		wantCORS   string
+	}{
+		{"allowed", "/api/image?w=50&url=" + imageURL, "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"width over limit", "/api/image?w=51&url=" + imageURL, "", http.StatusBadRequest, ""},
+		{"host not allowed", "/api/image?url=" + url.QueryEscape("http://example.com/a.png"), "", http.StatusBadRequest, ""},
+		{"origin not allowed", "/api/image?w=50&url=" + imageURL, "https://evil.example.com", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantCORS {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantCORS)
+			}
+		})
+	}
+}
+
+func TestImageHandler_Preflight(t *testing.T) {
+	var authorized atomic.Int32
+	handler := &ImageHandler{
+		Cache:    cache.NewNoopCache(),
+		Verifier: signature.NewVerifier([]byte("secret")),
+		CORS:     &cors.Policy{AllowedOrigins: []string{"https://*.example.com"}, MaxAge: time.Hour},
+		Authorize: func(r *http.Request) error {
+			authorized.Add(1)
+			return ErrUnauthorized
+		},
+	}
+
+	// Preflights carry no signature or credentials, and are answered before
+	// either is checked
+	req := httptest.NewRequest(http.MethodOptions, "/api/image?url=https://example.com/a.png", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	handler.ServeImage(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST, OPTIONS" {
+		t.Errorf("Access-Control-Allow-Methods = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "3600" {
+		t.Errorf("Access-Control-Max-Age = %q", got)
+	}
+	if authorized.Load() != 0 {
+		t.Error("preflight was authorized")
+	}
+
+	// The actual request is still checked
+	req = httptest.NewRequest(http.MethodGet, "/api/image?url=https://example.com/a.png", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unsigned request status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("error response Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestImageHandler_PoolBusy(t *testing.T) {
+	data := newTestOrigin(t, 10, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewNoopCache(),
+		Pool:    pool.New(1, 0, 0),
+	}
+
+	// Occupy the only worker
+	busy := make(chan struct{})
+	release := make(chan struct{})
+	go handler.Pool.Do(context.Background(), func() error {
+		close(busy)
+		<-release
+		return nil
+	})
+	<-busy
+
+	req := httptest.NewRequest("GET", "/api/image?url="+url.QueryEscape(origin.URL+"/a.png"), nil)
+	w := httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("ServeImage() with busy pool = %v, Retry-After %q, want 503", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	for handler.Pool.Active() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeImage(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("ServeImage() with free pool = %v, want 200", w.Code)
+	}
+}
+
+func TestImageHandler_Cancellation(t *testing.T) {
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer origin.Close()
+
+	opts := fetch.DefaultOptions()
+	opts.Retries = 0
+	handler := &ImageHandler{
+		Fetcher: fetch.New(opts),
+		Cache:   cache.NewNoopCache(),
+	}
+	imageURL := "/api/image?url=" + url.QueryEscape(origin.URL+"/a.png")
+
+	t.Run("client disconnects", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", imageURL, nil).WithContext(ctx)
+		done := make(chan struct{})
+		go func() {
+			handler.ServeImage(httptest.NewRecorder(), req)
+			close(done)
+		}()
+
+		<-started
+		cancel()
+		select {
+		case <-aborted:
+		case <-time.After(time.Second):
+			t.Error("upstream fetch not canceled")
+		}
+		<-done
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		handler.Timeout = 50 * time.Millisecond
+		defer func() { handler.Timeout = 0 }()
+
+		w := httptest.NewRecorder()
+		handler.ServeImage(w, httptest.NewRequest("GET", imageURL, nil))
+		<-started
+		<-aborted
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("ServeImage() status = %v, want %v", w.Code, http.StatusGatewayTimeout)
+		}
+	})
+
+	t.Run("picture deadline", func(t *testing.T) {
+		handler.Timeout = 50 * time.Millisecond
+		defer func() { handler.Timeout = 0 }()
+
+		w := httptest.NewRecorder()
+		handler.ServePicture(w, httptest.NewRequest("GET", "/api/picture?widths=320&url="+url.QueryEscape(origin.URL+"/a.png"), nil))
+		<-started
+		select {
+		case <-aborted:
+		case <-time.After(time.Second):
+			t.Error("upstream fetch not canceled")
+		}
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("ServePicture() status = %v, want %v", w.Code, http.StatusGatewayTimeout)
+		}
+	})
+}
+
+func TestImageHandler_Metrics(t *testing.T) {
+	data := newTestOrigin(t, 10, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	m := NewMetrics()
+	opts := fetch.DefaultOptions()
+	opts.Observe = m.ObserveFetch
+	handler := &ImageHandler{
+		Fetcher: fetch.New(opts),
+		Cache:   m.InstrumentCache(cache.NewMemoryCache(10, time.Hour), "image", "memory"),
+		Metrics: m,
+	}
+	for _, u := range []string{
+		"/api/image?fmt=jpeg&url=" + url.QueryEscape(origin.URL+"/a.png"),
+		"/api/image?fmt=jpeg&url=" + url.QueryEscape(origin.URL+"/a.png"),
+		"/api/image?url=" + url.QueryEscape(origin.URL+"/missing.png"),
+		"/api/image?metadata=true&url=" + url.QueryEscape(origin.URL+"/a.png"),
+	} {
+		handler.ServeImage(httptest.NewRecorder(), httptest.NewRequest("GET", u, nil))
+	}
+
+	w := httptest.NewRecorder()
+	m.Registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`openimg_requests_total{mode="image",format="jpeg",status="200"} 2`,
+		`openimg_requests_total{mode="image",format="",status="404"} 1`,
+		`openimg_requests_total{mode="metadata",format="",status="200"} 1`,
+		`openimg_cache_requests_total{cache="image",backend="memory",result="hit"} 1`,
+		`openimg_cache_requests_total{cache="image",backend="memory",result="miss"} 2`,
+		`openimg_upstream_errors_total{reason="not_found"} 1`,
+		`openimg_upstream_request_duration_seconds_count{result="ok"} 2`,
+		`openimg_encode_duration_seconds_count{format="jpeg"} 1`,
+		fmt.Sprintf("openimg_source_bytes_total %d", len(data)),
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestImageHandler_AccessLog(t *testing.T) {
+	data := newTestOrigin(t, 10, 10)
+	var upstreamIDs []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamIDs = append(upstreamIDs, r.Header.Get(requestid.Header))
+		if r.URL.Path == "/broken.png" {
+			w.Write([]byte("not an image"))
+			return
+		}
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	logs := new(bytes.Buffer)
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewNoopCache(),
+		Logger:  slog.New(slog.NewJSONHandler(logs, nil)),
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		requestID string
+		wantErr   bool
+	}{
+		{"client request ID", "/a.png", "client-id-1", false},
+		{"generated request ID", "/a.png", "", false},
+		{"invalid request ID", "/a.png", "bad id", false},
+		{"decode error", "/broken.png", "client-id-2", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			upstreamIDs = nil
+			req := httptest.NewRequest("GET", "/api/image?w=5&fmt=png&url="+url.QueryEscape(origin.URL+tt.path), nil)
+			if tt.requestID != "" {
+				req.Header.Set(requestid.Header, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			id := w.Header().Get(requestid.Header)
+			if !requestid.Valid(id) || (tt.requestID != "" && requestid.Valid(tt.requestID) && id != tt.requestID) {
+				t.Errorf("%s = %q", requestid.Header, id)
+			}
+			if len(upstreamIDs) != 1 || upstreamIDs[0] != id {
+				t.Errorf("upstream %s = %v, want %q", requestid.Header, upstreamIDs, id)
+			}
+
+			var entry struct {
+				RequestID string         `json:"request_id"`
+				Status    int            `json:"status"`
+				Source    string         `json:"source"`
+				Cache     string         `json:"cache"`
+				Options   map[string]any `json:"options"`
+				Stages    map[string]any `json:"stages"`
+				Error     string         `json:"error"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("access log %q: %v", logs, err)
+			}
+			if entry.RequestID != id || entry.Status != w.Code || entry.Source != origin.URL+tt.path || entry.Cache != "miss" {
+				t.Errorf("access log = %+v", entry)
+			}
+			if entry.Options["w"] != float64(5) || entry.Options["fmt"] != "png" {
+				t.Errorf("access log options = %v", entry.Options)
+			}
+			if _, ok := entry.Stages["fetch"]; !ok {
+				t.Errorf("access log stages = %v, want fetch", entry.Stages)
+			}
+			if (entry.Error != "") != tt.wantErr {
+				t.Errorf("access log error = %q, wantErr %v", entry.Error, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageHandler_ErrorResponses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("not an image"))
+	}))
+	defer origin.Close()
+
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Cache:   cache.NewNoopCache(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/image", handler.ServeImage)
+	mux.Handle("/img/", http.StripPrefix("/img", http.HandlerFunc(handler.ServePath)))
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		wantStatus int
+		wantCode   string
+	}{
+		{"missing url", "GET", "/api/image?w=100", http.StatusBadRequest, "missing_url"},
+		{"invalid width", "GET", "/api/image?w=5000&url=" + url.QueryEscape(origin.URL+"/a.png"), http.StatusBadRequest, "invalid_width"},
+		{"invalid format", "GET", "/api/image?fmt=gif&url=" + url.QueryEscape(origin.URL+"/a.png"), http.StatusBadRequest, "invalid_format"},
+		{"unknown source", "GET", "/api/image?src=nope&path=a.png", http.StatusBadRequest, "unknown_source"},
+		{"unknown preset", "GET", "/api/image?preset=hero&url=" + url.QueryEscape(origin.URL+"/a.png"), http.StatusBadRequest, "unknown_preset"},
+		{"invalid path", "GET", "/img/w_abc/x", http.StatusBadRequest, "invalid_path"},
+		{"method not allowed", "DELETE", "/api/image", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"upstream not found", "GET", "/api/image?url=" + url.QueryEscape(origin.URL+"/missing.png"), http.StatusNotFound, "upstream_not_found"},
+		{"bad upstream image", "GET", "/api/image?url=" + url.QueryEscape(origin.URL+"/a.png"), http.StatusBadGateway, "decode_failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var body errorBody
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid error body %q: %v", w.Body, err)
+			}
+			if body.Code != tt.wantCode || body.Message == "" {
+				t.Errorf("error body = %+v, want code %q", body, tt.wantCode)
+			}
+			if body.RequestID == "" || body.RequestID != w.Header().Get(requestid.Header) {
+				t.Errorf("error body request ID = %q, header %q", body.RequestID, w.Header().Get(requestid.Header))
+			}
+		})
+	}
+}
+
+func TestImageHandler_Health(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	opts := fetch.DefaultOptions()
+	opts.Retries = 0
+	busy := pool.New(1, 0, 0)
+	release := make(chan struct{})
+	defer close(release)
+	go busy.Do(context.Background(), func() error { <-release; return nil })
+	for !busy.Saturated() {
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		name       string
+		handler    *ImageHandler
+		wantStatus int
+		wantCheck  string // Check expected to fail, if any
+	}{
+		{"ready", &ImageHandler{Cache: cache.NewMemoryCache(1, time.Hour), Pool: pool.New(1, 1, 0)}, http.StatusOK, ""},
+		{"disk cache unavailable", &ImageHandler{Cache: cache.NewDiskCache(filepath.Join(t.TempDir(), "missing"))}, http.StatusServiceUnavailable, "cache"},
+		{"pool saturated", &ImageHandler{Cache: cache.NewNoopCache(), Pool: busy}, http.StatusServiceUnavailable, "pool"},
+		{"upstream up", &ImageHandler{Cache: cache.NewNoopCache(), Fetcher: fetch.New(opts), HealthUpstream: upstream.URL + "/up"}, http.StatusOK, ""},
+		{"upstream down", &ImageHandler{Cache: cache.NewNoopCache(), Fetcher: fetch.New(opts), HealthUpstream: upstream.URL + "/down"}, http.StatusServiceUnavailable, "upstream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeReady(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("Status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var body readyBody
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			for name, result := range body.Checks {
+				if failed := result != "ok"; failed != (name == tt.wantCheck) {
+					t.Errorf("check %s = %q", name, result)
+				}
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	(&ImageHandler{}).ServeHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/healthz status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	(&ImageHandler{}).ServeVersion(w, httptest.NewRequest("GET", "/version", nil))
+	var version versionBody
+	if err := json.Unmarshal(w.Body.Bytes(), &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.GoVersion == "" || version.Codecs["jpeg"] == "" || version.Codecs["avif"] == "" {
+		t.Errorf("/version = %+v, want the Go version and codecs", version)
+	}
+}
+
+func TestImageHandler_Upload(t *testing.T) {
+	img := newTestOrigin(t, 40, 20)
+
+	multipartBody := func(field, filename string, data []byte) (string, *bytes.Buffer) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		mw.WriteField("note", "ignored")
+		part, err := mw.CreateFormFile(field, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+		mw.Close()
+		return mw.FormDataContentType(), body
+	}
+
+	handler := &ImageHandler{
+		Cache:          cache.NewMemoryCache(10, time.Hour),
+		MaxUploadBytes: int64(len(img)),
+	}
+
+	tests := []struct {
+		name            string
+		url             string
+		contentType     string
+		body            []byte
+		wantStatus      int
+		wantContentType string
+		wantCode        string
+	}{
+		{"raw", "/api/image?w=20&fmt=jpeg", "image/png", img, http.StatusOK, "image/jpeg", ""},
+		{"raw keeps format", "/api/image?w=20", "application/octet-stream", img, http.StatusOK, "image/png", ""},
+		{"metadata", "/api/image?metadata=true", "image/png", img, http.StatusOK, "application/json", ""},
+		{"invalid options", "/api/image?w=100000", "image/png", img, http.StatusBadRequest, "", "invalid_width"},
+		{"empty", "/api/image", "image/png", nil, http.StatusBadRequest, "", "missing_image"},
+		{"too large", "/api/image", "image/png", append(img, 0), http.StatusRequestEntityTooLarge, "", "source_too_large"},
+		{"not an image", "/api/image", "image/png", []byte("hello"), http.StatusUnprocessableEntity, "", "invalid_image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.url, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantContentType != "" && w.Header().Get("Content-Type") != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), tt.wantContentType)
+			}
+			if tt.wantCode != "" {
+				var body errorBody
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("error code = %q (%v), want %q", body.Code, err, tt.wantCode)
+				}
+			}
+		})
+	}
+
+	t.Run("multipart with metadata and placeholder", func(t *testing.T) {
+		contentType, body := multipartBody("upload", "a.png", img)
+		r := httptest.NewRequest("POST", "/api/image?metadata=true&placeholder=true&w=10", body)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeImage(w, r)
+
+		var info uploadInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		if info.Metadata == nil || info.Metadata.Width != 40 || !strings.HasPrefix(info.Placeholder, "data:image/jpeg;base64,") {
+			t.Errorf("response = %s, want metadata and a placeholder", w.Body)
+		}
+	})
+
+	t.Run("multipart without a file", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		mw.WriteField("note", "no image")
+		mw.Close()
+		r := httptest.NewRequest("POST", "/api/image", body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeImage(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Status = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestImageHandler_Batch(t *testing.T) {
+	data := newTestOrigin(t, 40, 20)
+	var fetches int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	handler := &ImageHandler{
+		Fetcher:      fetch.New(fetch.DefaultOptions()),
+		Cache:        cache.NewNoopCache(),
+		MaxBatchJobs: 5,
+		BatchWorkers: 4,
+	}
+	jobs := `[
+		{"id": "small", "source": "` + origin.URL + `/a.png", "options": {"w": 10, "fmt": "jpeg"}},
+		{"id": "large", "source": "` + origin.URL + `/a.png", "options": {"w": 20, "fmt": "png"}},
+		{"source": "` + origin.URL + `/a.png", "options": {"w": 100000}},
+		{"id": "missing", "source": "` + origin.URL + `/missing.png"}
+	]`
+
+	w := httptest.NewRecorder()
+	handler.ServeBatch(w, httptest.NewRequest("POST", "/api/batch", strings.NewReader(jobs)))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Status = %d, Content-Type = %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	results := map[string]batchResult{}
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var result batchResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		results[result.ID] = result
+	}
+
+	for id, want := range map[string]struct {
+		status      int
+		contentType string
+		code        string
+	}{
+		"small":   {http.StatusOK, "image/jpeg", ""},
+		"large":   {http.StatusOK, "image/png", ""},
+		"2":       {http.StatusBadRequest, "", "invalid_width"},
+		"missing": {http.StatusNotFound, "", "upstream_not_found"},
+	} {
+		got, ok := results[id]
+		switch {
+		case !ok:
+			t.Errorf("no result for job %s", id)
+		case got.Status != want.status || got.ContentType != want.contentType:
+			t.Errorf("job %s = %d %q, want %d %q", id, got.Status, got.ContentType, want.status, want.contentType)
+		case want.code != "" && (got.Error == nil || got.Error.Code != want.code):
+			t.Errorf("job %s error = %+v, want code %q", id, got.Error, want.code)
+		case want.code == "" && len(got.Data) == 0:
+			t.Errorf("job %s has no data", id)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("source fetched %d times, want 1", n)
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/api/batch", strings.NewReader(`[{"id": "a", "source": "`+origin.URL+`/a.png", "options": {"fmt": "png"}}]`))
+		r.Header.Set("Accept", "multipart/mixed")
+		w := httptest.NewRecorder()
+		handler.ServeBatch(w, r)
+
+		_, ps, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr := multipart.NewReader(w.Body, ps["boundary"])
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("X-Job-Id") != "a" || part.Header.Get("X-Status") != "200" || part.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("part header = %v", part.Header)
+		}
+		if _, err := mr.NextPart(); err != io.EOF {
+			t.Errorf("NextPart() error = %v, want io.EOF after the only result", err)
+		}
+	})
+
+	for name, body := range map[string]string{
+		"not a list":    `{"source": "x"}`,
+		"empty":         `[]`,
+		"too many jobs": `[{}, {}, {}, {}, {}, {}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeBatch(w, httptest.NewRequest("POST", "/api/batch", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestImageHandler_Picture(t *testing.T) {
+	data := newTestOrigin(t, 800, 400)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer origin.Close()
+
+	key := []byte("secret")
+	signer := signature.NewSigner(key)
+	handler := &ImageHandler{
+		Fetcher:   fetch.New(fetch.DefaultOptions()),
+		Cache:     cache.NewMemoryCache(10, time.Hour),
+		Verifier:  signature.NewVerifier(key),
+		Signer:    signer,
+		PublicURL: "https://img.example.com/",
+	}
+	get := func(t *testing.T, rawURL string) *httptest.ResponseRecorder {
+		signed, err := signer.SignURL(rawURL, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServePicture(w, httptest.NewRequest("GET", signed, nil))
+		return w
+	}
+	base := "/api/picture?widths=320,640,1600&formats=webp,jpeg&sizes=100vw&alt=" + url.QueryEscape(`A "cat"`) +
+		"&url=" + url.QueryEscape(origin.URL+"/a.png")
+
+	w := get(t, base)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d: %s", w.Code, w.Body)
+	}
+	var p picture
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Width != 640 || p.Height != 320 {
+		t.Errorf("size = %dx%d, want 640x320 (1600 exceeds the source)", p.Width, p.Height)
+	}
+	if len(p.Sources) != 2 || p.Sources[0].Type != "image/webp" || p.Sources[1].Type != "image/jpeg" || len(p.Sources[1].URLs) != 2 {
+		t.Fatalf("sources = %+v", p.Sources)
+	}
+	if !strings.HasPrefix(p.Src, "https://img.example.com/img/w_640,f_jpeg/") || p.Src != p.Sources[1].URLs[1].URL {
+		t.Errorf("src = %q", p.Src)
+	}
+	if !strings.HasPrefix(p.Placeholder, "data:image/jpeg;base64,") {
+		t.Errorf("placeholder = %.40q", p.Placeholder)
+	}
+	for _, want := range []string{`<source type="image/webp" srcset="https://img.example.com/img/w_320,f_webp/`, ` 320w, `, `sizes="100vw"`, `alt="A &#34;cat&#34;"`, `width="640" height="320"`, `url(data:image/jpeg;base64,`} {
+		if !strings.Contains(p.HTML, want) {
+			t.Errorf("HTML does not contain %q:\n%s", want, p.HTML)
+		}
+	}
+
+	// The generated URLs are signed and served by the path API
+	u, err := url.Parse(p.Sources[1].URLs[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := httptest.NewRecorder()
+	http.StripPrefix("/img", http.HandlerFunc(handler.ServePath)).ServeHTTP(img, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if img.Code != http.StatusOK || img.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("rendition status = %d, Content-Type = %q: %s", img.Code, img.Header().Get("Content-Type"), img.Body)
+	}
+
+	w = get(t, base+"&output=html&placeholder=false")
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" || !strings.HasPrefix(w.Body.String(), "<picture>") || strings.Contains(w.Body.String(), "data:") {
+		t.Errorf("output=html: Content-Type = %q, body = %s", ct, w.Body)
+	}
+
+	w = get(t, strings.Replace(base, "formats=webp,jpeg", "formats=gif", 1))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported format status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	for _, widths := range []string{"0", "320,-1", "320,wide"} {
+		w = get(t, strings.Replace(base, "widths=320,640,1600", "widths="+widths, 1))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"invalid_params"`) {
+			t.Errorf("widths=%s: status = %d: %s", widths, w.Code, w.Body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServePicture(w, httptest.NewRequest("GET", base, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unsigned request status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestImageHandler_APIKeys(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.png"), newTestOrigin(t, 100, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	local, err := source.NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := auth.New([]auth.Key{
+		{ID: "team-a", Secret: "aaaaaaaaaaaaaaaa", RateLimit: 0.001, Burst: 3},
+		{ID: "team-b", Secret: "bbbbbbbbbbbbbbbb", AllowedOrigins: []string{"images.example.com"}, AllowedPresets: []string{"card"}},
+		{ID: "team-c", Secret: "cccccccccccccccc-batch", RateLimit: 0.001, Burst: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := new(bytes.Buffer)
+	metrics := NewMetrics()
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Sources: map[string]source.Source{"local": local},
+		Cache:   cache.NewNoopCache(),
+		Presets: &preset.Set{Presets: map[string]preset.Preset{
+			"card": {Width: 40, Format: "png", Override: []string{"w", "fmt"}},
+		}},
+		APIKeys: keys,
+		Metrics: metrics,
+		Logger:  slog.New(slog.NewJSONHandler(logs, nil)),
+	}
+	mux := http.NewServeMux()
+	handler.Register(mux)
+
+	tests := []struct {
+		name           string
+		url            string
+		key            string // Sent in the X-API-Key header
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter string
+	}{
+		{"missing key", "/api/image?src=local&path=a.png&w=50", "", http.StatusUnauthorized, "missing_api_key", ""},
+		{"invalid key", "/api/image?src=local&path=a.png&w=50", "cccccccccccccccc", http.StatusUnauthorized, "invalid_api_key", ""},
+		{"header", "/api/image?src=local&path=a.png&w=50&fmt=png", "aaaaaaaaaaaaaaaa", http.StatusOK, "", ""},
+		{"query", "/img/w_50,f_png,src_local/a.png?key=aaaaaaaaaaaaaaaa", "", http.StatusOK, "", ""},
+		{"within burst", "/api/image?src=local&path=a.png&w=50&fmt=png", "aaaaaaaaaaaaaaaa", http.StatusOK, "", ""},
+		{"rate limited", "/api/image?src=local&path=a.png&w=50&fmt=png", "aaaaaaaaaaaaaaaa", http.StatusTooManyRequests, "rate_limited", "1000"},
+		{"allowed preset", "/api/image?src=local&path=a.png&preset=card", "bbbbbbbbbbbbbbbb", http.StatusOK, "", ""},
+		{"preset required", "/api/image?src=local&path=a.png&w=50", "bbbbbbbbbbbbbbbb", http.StatusForbidden, "preset_not_allowed", ""},
+		{"picture without signing", "/api/picture?src=local&path=a.png&preset=card&widths=50&formats=png", "bbbbbbbbbbbbbbbb", http.StatusForbidden, "signing_required", ""},
+		{"origin not allowed", "/api/image?preset=card&url=" + url.QueryEscape("https://other.example.com/a.png"), "bbbbbbbbbbbbbbbb", http.StatusBadRequest, "host_not_allowed", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantCode != "" {
+				var body errorBody
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("error code = %q (%v), want %q", body.Code, err, tt.wantCode)
+				}
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+
+	// Each job of a batch counts against the key's rate limit, on top of
+	// the batch request itself
+	batch := httptest.NewRequest("POST", "/api/batch", strings.NewReader(`[
+		{"id": "1", "source": "local:a.png", "options": {"w": 10, "fmt": "png"}},
+		{"id": "2", "source": "local:a.png", "options": {"w": 20, "fmt": "png"}},
+		{"id": "3", "source": "local:a.png", "options": {"w": 30, "fmt": "png"}}
+	]`))
+	batch.Header.Set("X-API-Key", "cccccccccccccccc-batch")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, batch)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch status = %d: %s", w.Code, w.Body)
+	}
+	statuses := map[int]int{}
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var result batchResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		statuses[result.Status]++
+		if result.Status == http.StatusTooManyRequests && (result.Error == nil || result.Error.Code != "rate_limited") {
+			t.Errorf("limited job error = %+v, want code rate_limited", result.Error)
+		}
+	}
+	if statuses[http.StatusOK] != 2 || statuses[http.StatusTooManyRequests] != 1 {
+		t.Errorf("batch job statuses = %v, want 2 OK and 1 rate limited", statuses)
+	}
+
+	// Browsers may send keys cross-origin, and preflights need none
+	preflight := httptest.NewRequest(http.MethodOptions, "/api/image", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "GET")
+	preflight.Header.Set("Access-Control-Request-Headers", "x-api-key")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, preflight)
+	if got := w.Header().Get("Access-Control-Allow-Headers"); w.Code != http.StatusNoContent || !strings.Contains(got, "X-API-Key") || !strings.Contains(got, "Authorization") {
+		t.Errorf("preflight: status = %v, Access-Control-Allow-Headers = %q", w.Code, got)
+	}
+
+	// Picture requests must send their key in a header, and it is never
+	// copied into the generated URLs
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/picture?src=local&path=a.png&preset=card&widths=40&formats=png&placeholder=false&key=bbbbbbbbbbbbbbbb", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "api_key_in_query") {
+		t.Errorf("picture with a query key: status = %v: %s", w.Code, w.Body)
+	}
+
+	// With signing, the renditions are signed and load without a key
+	signingKey := []byte("secret")
+	signer := signature.NewSigner(signingKey)
+	handler.Signer, handler.Verifier = signer, signature.NewVerifier(signingKey)
+	getPicture := func(rawURL string) *httptest.ResponseRecorder {
+		signed, err := signer.SignURL(rawURL, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", signed, nil)
+		req.Header.Set("X-API-Key", "bbbbbbbbbbbbbbbb")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	if w := getPicture("/api/picture?src=local&path=a.png&widths=40&formats=png"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "preset_not_allowed") {
+		t.Errorf("picture without the key's preset: status = %v: %s", w.Code, w.Body)
+	}
+	w = getPicture("/api/picture?src=local&path=a.png&preset=card&widths=40&formats=png&placeholder=false")
+	var picture struct{ Src, HTML string }
+	if err := json.Unmarshal(w.Body.Bytes(), &picture); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if picture.Src == "" || strings.Contains(picture.Src+picture.HTML, "bbbbbbbbbbbbbbbb") {
+		t.Errorf("picture = %+v, want rendition URLs without the key", picture)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", picture.Src, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("GET %s without a key: status = %v: %s", picture.Src, w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/img/w_40,f_png,src_local/a.png", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unsigned request without a key: status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	// Requests are logged with their key, which is never logged itself
+	if strings.Contains(logs.String(), "aaaaaaaaaaaaaaaa") {
+		t.Errorf("access log contains an API key:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), `"key":"team-b"`) || !strings.Contains(logs.String(), "key=REDACTED") {
+		t.Errorf("access log is missing key IDs or redactions:\n%s", logs)
+	}
+	exposition := new(bytes.Buffer)
+	metrics.Registry.Write(exposition)
+	if want := `openimg_api_key_requests_total{key="team-a",status="429"} 1`; !strings.Contains(exposition.String(), want) {
+		t.Errorf("metrics missing %s:\n%s", want, exposition)
+	}
+}
+
+func TestImageHandler_RateLimits(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.png"), newTestOrigin(t, 100, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	local, err := source.NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := clientip.New([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics()
+	handler := &ImageHandler{
+		Fetcher: fetch.New(fetch.DefaultOptions()),
+		Sources: map[string]source.Source{"local": local},
+		Cache:   cache.NewMemoryCache(10, time.Hour),
+		Metrics: metrics,
+		RateLimits: &RateLimits{
+			Hits:    ratelimit.NewLimiter(ratelimit.Limit{Rate: 0.001, Burst: 2}),
+			Misses:  ratelimit.NewLimiter(ratelimit.Limit{Rate: 0.001, Burst: 1}),
+			Proxies: proxies,
+		},
+	}
+
+	const client = "203.0.113.1:5000"
+	tests := []struct {
+		name           string
+		width          int
+		remoteAddr     string
+		forwardedFor   string
+		wantStatus     int
+		wantRemaining  string // Of the most restrictive limit
+		wantRetryAfter string
+	}{
+		{"miss", 50, client, "", http.StatusOK, "0", ""},
+		{"hit", 50, client, "", http.StatusOK, "1", ""},
+		{"miss over limit", 60, client, "", http.StatusTooManyRequests, "0", "1000"},
+		{"other client behind proxy", 60, "10.0.0.5:80", "198.51.100.9", http.StatusOK, "0", ""},
+		{"spoofed header", 70, client, "198.51.100.77", http.StatusTooManyRequests, "0", "1000"},
+		{"last hit", 50, client, "", http.StatusOK, "0", ""},
+		{"hit over limit", 50, client, "", http.StatusTooManyRequests, "0", "1000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", fmt.Sprintf("/api/image?src=local&path=a.png&fmt=png&w=%d", tt.width), nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeImage(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("RateLimit-Remaining"); got != tt.wantRemaining {
+				t.Errorf("RateLimit-Remaining = %q, want %q", got, tt.wantRemaining)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && !strings.Contains(w.Body.String(), `"rate_limited"`) {
+				t.Errorf("body = %s, want code rate_limited", w.Body)
+			}
+		})
+	}
+
+	exposition := new(bytes.Buffer)
+	metrics.Registry.Write(exposition)
+	for _, want := range []string{`openimg_rate_limited_total{limit="hits"} 1`, `openimg_rate_limited_total{limit="misses"} 2`} {
+		if !strings.Contains(exposition.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+// newTestOrigin returns a w×h PNG image for tests to serve as an original
+func newTestOrigin(t *testing.T, w, h int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+// errSaturated is reported by the readiness check while the pool's queue is
+// full, so that load balancers send requests elsewhere
+var errSaturated = errors.New("worker pool queue is full")
+
+// readyBody is the JSON body of a readiness response
+type readyBody struct {
+	Status string            `json:"status"` // "ok" or "unavailable"
+	Checks map[string]string `json:"checks"` // "ok" or the error, per check
+}
+
+// versionBody is the JSON body of a version response
+type versionBody struct {
+	Module    string            `json:"module"`
+	Version   string            `json:"version"`
+	Revision  string            `json:"revision,omitempty"`
+	Time      string            `json:"time,omitempty"`
+	Modified  bool              `json:"modified,omitempty"`
+	GoVersion string            `json:"goVersion"`
+	Codecs    map[string]string `json:"codecs"` // Library encoding each output format
+}
+
+// ServeHealth reports that the process is alive, for liveness probes
+func (h *ImageHandler) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// ServeReady reports whether the handler can serve images, for readiness
+// probes. It responds with 503 unless the caches are usable, the worker pool
+// is accepting work and, if configured, the upstream probe URL can be fetched.
+func (h *ImageHandler) ServeReady(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if h.HealthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.HealthTimeout)
+		defer cancel()
+	}
+
+	body := readyBody{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			body.Status = "unavailable"
+			body.Checks[name] = err.Error()
+			return
+		}
+		body.Checks[name] = "ok"
+	}
+
+	check("cache", cache.Ping(ctx, h.Cache))
+	if h.SourceCache != nil {
+		check("sourceCache", h.SourceCache.Ping(ctx))
+	}
+	if h.Pool != nil {
+		var err error
+		if h.Pool.Saturated() {
+			err = errSaturated
+		}
+		check("pool", err)
+	}
+	if h.HealthUpstream != "" && h.Fetcher != nil {
+		resp, err := h.Fetcher.Get(ctx, h.HealthUpstream)
+		if err == nil {
+			resp.Body.Close()
+		}
+		check("upstream", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if body.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// ServeVersion reports the build information and available codecs
+func (h *ImageHandler) ServeVersion(w http.ResponseWriter, r *http.Request) {
+	body := versionBody{
+		Version:   "(devel)",
+		GoVersion: runtime.Version(),
+		Codecs:    transform.Codecs(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		body.Module = info.Main.Path
+		if info.Main.Version != "" {
+			body.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				body.Revision = s.Value
+			case "vcs.time":
+				body.Time = s.Value
+			case "vcs.modified":
+				body.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+var (
+	errDecode         = transform.ErrDecode
+	errSourceTooLarge = errors.New("source image is too large")
+	errTooManyPixels  = transform.ErrTooManyPixels
+)
+
+// readLimited reads r fully, failing once more than max bytes have been read.
+// A max of zero or less means no limit.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", errSourceTooLarge, max)
+	}
+	return data, nil
+}
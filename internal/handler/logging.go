@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/requestid"
+)
+
+// requestLog collects what happened while serving a request, for its access
+// log entry
+type requestLog struct {
+	key    string      // ID of the API key the request was made with
+	source string      // Identifier of the original image
+	cache  string      // "hit" or "miss" for the rendition cache
+	stages []slog.Attr // Time spent in each stage, in order
+	err    error       // The internal error behind a failure
+}
+
+type requestLogKey struct{}
+
+// logFrom returns the request log in ctx. Outside of a served request it
+// returns a throwaway log, so callers don't need to check.
+func logFrom(ctx context.Context) *requestLog {
+	if l, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return l
+	}
+	return &requestLog{}
+}
+
+// stage records the time spent in a stage that began at start
+func (l *requestLog) stage(name string, start time.Time) {
+	l.stages = append(l.stages, slog.Duration(name, time.Since(start)))
+}
+
+// begin starts serving r. It assigns the request ID, reusing a valid
+// X-Request-ID from the client, and returns the writer and request to serve
+// with, and a function to call once served, which records metrics and writes
+// the access log.
+func (h *ImageHandler) begin(w http.ResponseWriter, r *http.Request) (*trackedResponse, *http.Request, func(params.Request)) {
+	start := time.Now()
+	id := r.Header.Get(requestid.Header)
+	if !requestid.Valid(id) {
+		id = requestid.New()
+	}
+	w.Header().Set(requestid.Header, id)
+
+	l := &requestLog{}
+	ctx := context.WithValue(requestid.NewContext(r.Context(), id), requestLogKey{}, l)
+	r = r.WithContext(ctx)
+	tw := &trackedResponse{ResponseWriter: w}
+
+	return tw, r, func(req params.Request) {
+		elapsed := time.Since(start)
+		h.Metrics.observeRequest(req.Mode, l.key, tw, elapsed)
+		h.logRequest(r, id, req, tw, l, elapsed)
+		if h.OnRequest != nil {
+			h.OnRequest(r.Context(), requestInfo(r, id, req, tw, l, elapsed))
+		}
+	}
+}
+
+// logRequest writes the access log entry of a request
+func (h *ImageHandler) logRequest(r *http.Request, id string, req params.Request, w *trackedResponse, l *requestLog, elapsed time.Duration) {
+	mode := req.Mode
+	if mode == "" {
+		mode = "image"
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("method", r.Method),
+		slog.String("uri", redactURI(r.RequestURI)),
+		slog.String("mode", mode),
+		slog.Int("status", w.Status()),
+		slog.Int64("bytes", w.bytes),
+		slog.Duration("duration", elapsed),
+	}
+	if l.key != "" {
+		attrs = append(attrs, slog.String("key", l.key))
+	}
+	if l.source != "" {
+		attrs = append(attrs, slog.String("source", l.source))
+	}
+	if opts := optionAttrs(req); len(opts) > 0 {
+		attrs = append(attrs, slog.Attr{Key: "options", Value: slog.GroupValue(opts...)})
+	}
+	if l.cache != "" {
+		attrs = append(attrs, slog.String("cache", l.cache))
+	}
+	if len(l.stages) > 0 {
+		attrs = append(attrs, slog.Attr{Key: "stages", Value: slog.GroupValue(l.stages...)})
+	}
+	if l.err != nil {
+		attrs = append(attrs, slog.String("error", l.err.Error()))
+	}
+
+	level := slog.LevelInfo
+	if w.Status() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	h.logger().LogAttrs(r.Context(), level, "request", attrs...)
+}
+
+// RequestInfo describes a served request, for the OnRequest hook
+type RequestInfo struct {
+	ID       string
+	Method   string
+	URI      string // Request URI, with any API key redacted
+	Mode     string // "image", "metadata", "placeholder", "batch" or "picture"
+	Key      string // ID of the API key the request was made with, if any
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+	Source   string                   // Source URL, or <name>:<path> for a named source
+	Cache    string                   // "hit" or "miss", if the cache was consulted
+	Stages   map[string]time.Duration // Time spent in each stage, e.g. fetch and encode
+	Err      error
+}
+
+// requestInfo collects the details of a served request for the OnRequest hook
+func requestInfo(r *http.Request, id string, req params.Request, w *trackedResponse, l *requestLog, elapsed time.Duration) RequestInfo {
+	info := RequestInfo{
+		ID:       id,
+		Method:   r.Method,
+		URI:      redactURI(r.RequestURI),
+		Mode:     req.Mode,
+		Key:      l.key,
+		Status:   w.Status(),
+		Bytes:    w.bytes,
+		Duration: elapsed,
+		Source:   l.source,
+		Cache:    l.cache,
+		Err:      l.err,
+	}
+	if info.Mode == "" {
+		info.Mode = "image"
+	}
+	if len(l.stages) > 0 {
+		info.Stages = make(map[string]time.Duration, len(l.stages))
+		for _, stage := range l.stages {
+			info.Stages[stage.Key] = stage.Value.Duration()
+		}
+	}
+	return info
+}
+
+// redactURI hides the value of an API key sent in the query of uri, keeping
+// the rest as requested
+func redactURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); err == nil && name == auth.QueryParam {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// optionAttrs returns the requested options that are set
+func optionAttrs(req params.Request) []slog.Attr {
+	var attrs []slog.Attr
+	if req.Preset != "" {
+		attrs = append(attrs, slog.String("preset", req.Preset))
+	}
+	o := req.Options
+	for _, opt := range []struct {
+		name  string
+		value int
+	}{{"w", o.Width}, {"h", o.Height}, {"q", o.Quality}} {
+		if opt.value != 0 {
+			attrs = append(attrs, slog.Int(opt.name, opt.value))
+		}
+	}
+	if o.Format != "" {
+		attrs = append(attrs, slog.String("fmt", o.Format))
+	}
+	if o.Fit != "" {
+		attrs = append(attrs, slog.String("fit", o.Fit))
+	}
+	return attrs
+}
+
+func (h *ImageHandler) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
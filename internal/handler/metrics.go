@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/metrics"
+	"github.com/deyshin/openimg-go/internal/pool"
+)
+
+// Metrics are the server's Prometheus metrics. All methods do nothing on a
+// nil *Metrics, so handlers can be used without them.
+type Metrics struct {
+	Registry *metrics.Registry
+
+	requests         *metrics.CounterVec
+	keyRequests      *metrics.CounterVec
+	rateLimited      *metrics.CounterVec
+	requestDuration  *metrics.HistogramVec
+	responseBytes    *metrics.CounterVec
+	cacheRequests    *metrics.CounterVec
+	upstreamDuration *metrics.HistogramVec
+	upstreamErrors   *metrics.CounterVec
+	sourceBytes      *metrics.CounterVec
+	encodeDuration   *metrics.HistogramVec
+}
+
+// NewMetrics creates the server metrics in a new registry
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+	return &Metrics{
+		Registry: r,
+		requests: r.Counter("openimg_requests_total",
+			"Requests served, by mode, output format and status.", "mode", "format", "status"),
+		keyRequests: r.Counter("openimg_api_key_requests_total",
+			"Requests made with an API key, by key ID and status.", "key", "status"),
+		rateLimited: r.Counter("openimg_rate_limited_total",
+			"Requests rejected by a rate limit, by limit (key, hits or misses).", "limit"),
+		requestDuration: r.Histogram("openimg_request_duration_seconds",
+			"Time to serve a request, by mode, output format and status.", metrics.DefaultBuckets, "mode", "format", "status"),
+		responseBytes: r.Counter("openimg_response_bytes_total",
+			"Response body bytes sent, by mode.", "mode"),
+		cacheRequests: r.Counter("openimg_cache_requests_total",
+			"Cache lookups, by cache, backend and result (hit or miss).", "cache", "backend", "result"),
+		upstreamDuration: r.Histogram("openimg_upstream_request_duration_seconds",
+			"Time taken by upstream fetch attempts, by result.", metrics.DefaultBuckets, "result"),
+		upstreamErrors: r.Counter("openimg_upstream_errors_total",
+			"Failed upstream fetch attempts, by reason.", "reason"),
+		sourceBytes: r.Counter("openimg_source_bytes_total",
+			"Bytes of original images read from sources."),
+		encodeDuration: r.Histogram("openimg_encode_duration_seconds",
+			"Time to transform and encode an image, by output format.", metrics.DefaultBuckets, "format"),
+	}
+}
+
+// observeRequest records a served request, made with the API key with ID key
+// if it isn't empty
+func (m *Metrics) observeRequest(mode, key string, w *trackedResponse, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	if mode == "" {
+		mode = "image"
+	}
+	format := responseFormat(w.Header().Get("Content-Type"))
+	status := strconv.Itoa(w.Status())
+	m.requests.With(mode, format, status).Inc()
+	m.requestDuration.With(mode, format, status).Observe(elapsed.Seconds())
+	m.responseBytes.With(mode).Add(float64(w.bytes))
+	if key != "" {
+		m.keyRequests.With(key, status).Inc()
+	}
+}
+
+func (m *Metrics) observeRateLimited(limit string) {
+	if m == nil {
+		return
+	}
+	m.rateLimited.With(limit).Inc()
+}
+
+// ObserveFetch records an upstream fetch attempt; it is used as
+// fetch.Options.Observe
+func (m *Metrics) ObserveFetch(elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil && !errors.Is(err, fetch.ErrNotModified) {
+		result = "error"
+		m.upstreamErrors.With(upstreamErrorReason(err)).Inc()
+	}
+	m.upstreamDuration.With(result).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) addSourceBytes(n int) {
+	if m == nil {
+		return
+	}
+	m.sourceBytes.With().Add(float64(n))
+}
+
+func (m *Metrics) observeEncode(format string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.encodeDuration.With(format).Observe(elapsed.Seconds())
+}
+
+// ObservePool exposes the worker pool's load as gauges
+func (m *Metrics) ObservePool(p *pool.Pool) {
+	if m == nil || p == nil {
+		return
+	}
+	m.Registry.GaugeFunc("openimg_pool_active", "Images being processed.",
+		func() float64 { return float64(p.Active()) })
+	m.Registry.GaugeFunc("openimg_pool_queued", "Requests waiting to be processed.",
+		func() float64 { return float64(p.Queued()) })
+}
+
+// InstrumentCache counts hits and misses of c, which is the named cache
+// using the given backend
+func (m *Metrics) InstrumentCache(c cache.Cache, name, backend string) cache.Cache {
+	if m == nil {
+		return c
+	}
+	return &instrumentedCache{
+		Cache: c,
+		hits:  m.cacheRequests.With(name, backend, "hit"),
+		miss:  m.cacheRequests.With(name, backend, "miss"),
+	}
+}
+
+type instrumentedCache struct {
+	cache.Cache
+	hits *metrics.Counter
+	miss *metrics.Counter
+}
+
+func (c *instrumentedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.Cache.Get(ctx, key)
+	if err == nil {
+		c.hits.Inc()
+	} else {
+		c.miss.Inc()
+	}
+	return value, err
+}
+
+func (c *instrumentedCache) Close() error {
+	return cache.Close(c.Cache)
+}
+
+func (c *instrumentedCache) Ping(ctx context.Context) error {
+	return cache.Ping(ctx, c.Cache)
+}
+
+func (c *instrumentedCache) MaxEntrySize() int {
+	return cache.MaxEntrySize(c.Cache)
+}
+
+// upstreamErrorReason classifies a failed fetch for metrics
+func upstreamErrorReason(err error) string {
+	var statusErr *fetch.StatusError
+	switch {
+	case errors.Is(err, fetch.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, fetch.ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, fetch.ErrTooManyRedirects):
+		return "redirects"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case fetch.IsTimeout(err):
+		return "timeout"
+	case errors.As(err, &statusErr):
+		return "status_" + strconv.Itoa(statusErr.StatusCode)
+	default:
+		return "network"
+	}
+}
+
+// responseFormat returns the image format of a content type, e.g. webp for
+// image/webp, or "" if it is not an image
+func responseFormat(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	format, ok := strings.CutPrefix(strings.TrimSpace(mediaType), "image/")
+	if !ok {
+		return ""
+	}
+	return format
+}
+
+// trackedResponse records the status and size of a response
+type trackedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *trackedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the response status, which is 200 if none was written
+func (w *trackedResponse) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *trackedResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/metadata"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/transform"
+	"github.com/deyshin/openimg-go/internal/validate"
+)
+
+// modePicture is the mode picture requests are logged and counted under
+const modePicture = "picture"
+
+// defaultPictureWidths are the rendition widths used when none are requested
+var defaultPictureWidths = []int{320, 640, 960, 1280, 1920}
+
+// picture describes the responsive markup of an image
+type picture struct {
+	Width       int             `json:"width"` // Intrinsic size of the largest rendition
+	Height      int             `json:"height"`
+	Placeholder string          `json:"placeholder,omitempty"`
+	Sizes       string          `json:"sizes,omitempty"`
+	Sources     []pictureSource `json:"sources"` // One per format, the fallback last
+	Src         string          `json:"src"`     // Fallback URL for the <img> element
+	Alt         string          `json:"alt"`
+	HTML        string          `json:"html"`
+}
+
+// pictureSource lists the renditions of an image in one format
+type pictureSource struct {
+	Format string             `json:"format"`
+	Type   string             `json:"type"`
+	Srcset string             `json:"srcset"`
+	URLs   []pictureRendition `json:"urls"`
+}
+
+// pictureRendition is the URL of a rendition of a given width
+type pictureRendition struct {
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+var pictureTemplate = template.Must(template.New("picture").Parse(
+	`<picture>
+{{- range .Alternatives}}
+  <source type="{{.Type}}" srcset="{{.Srcset}}"{{with $.Sizes}} sizes="{{.}}"{{end}}>
+{{- end}}
+  <img src="{{.Src}}" srcset="{{.Fallback.Srcset}}"{{with .Sizes}} sizes="{{.}}"{{end}} width="{{.Width}}" height="{{.Height}}" alt="{{.Alt}}" loading="lazy" decoding="async"
+{{- with .Placeholder}} style="background-size: cover; background-image: url({{.}})"{{end}}>
+</picture>`))
+
+// ServePicture handles /api/picture requests, which describe the renditions
+// of an image for responsive markup, e.g.
+//
+//	/api/picture?url=...&widths=320,640,1280&formats=avif,webp,jpeg&sizes=100vw
+//
+// It responds with JSON including ready-to-use <picture> HTML, or with the
+// HTML alone given output=html. The rendition URLs use the path API, relative
+// to PublicURL and Prefix, and are signed when the handler has a Signer. Widths beyond
+// the source's are dropped so images are never upscaled.
+func (h *ImageHandler) ServePicture(w http.ResponseWriter, r *http.Request) {
+	tw, r, done := h.begin(w, r)
+	q := r.URL.Query()
+	req := params.ParseQuery(q)
+	defer func() {
+		req.Mode = modePicture
+		done(req)
+	}()
+
+	r, ok := h.checkRequest(tw, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	if h.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	// The generated markup is meant for public pages, so a key in the query
+	// would end up in them if clients copied it around
+	if h.APIKeys != nil && auth.FromHeader(r) == "" && auth.FromRequest(r) != "" {
+		writeError(tw, r, errorf(http.StatusBadRequest, "api_key_in_query", "picture requests must send their API key in the %s or Authorization header", auth.Header))
+		return
+	}
+	// Browsers load the renditions without a key, so they must be signed
+	if h.APIKeys != nil && (h.Signer == nil || h.Verifier == nil) {
+		writeError(tw, r, errorf(http.StatusForbidden, "signing_required", "picture requests need URL signing when API keys are required"))
+		return
+	}
+	if req.Mode != params.ModeImage {
+		writeError(tw, r, errorf(http.StatusBadRequest, "invalid_picture", "metadata and placeholder cannot be combined with picture requests"))
+		return
+	}
+	widths, err := parseWidths(q.Get("widths"))
+	if err != nil {
+		writeError(tw, r, err)
+		return
+	}
+	var formats []string
+	for _, format := range strings.Split(q.Get("formats"), ",") {
+		if format = strings.TrimSpace(format); format != "" && !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+
+	ref, err := h.resolveSource(r.Context(), req)
+	if err != nil {
+		writeError(tw, r, err)
+		return
+	}
+	if err := h.limitMiss(r.Context(), tw.Header()); err != nil {
+		writeError(tw, r, err)
+		return
+	}
+	data, _, err := h.readSource(r.Context(), ref)
+	if err != nil {
+		writeError(tw, r, err)
+		return
+	}
+	meta, err := metadata.Get(bytes.NewReader(data))
+	if err == nil && (meta.Width == 0 || meta.Height == 0) {
+		err = fmt.Errorf("image is %dx%d", meta.Width, meta.Height)
+	}
+	if err != nil {
+		writeError(tw, r, fmt.Errorf("%w: %w", errDecode, err))
+		return
+	}
+
+	if len(formats) == 0 {
+		formats = []string{transform.FormatWEBP, transform.FormatJPEG}
+		if meta.Format == transform.FormatPNG {
+			formats[1] = transform.FormatPNG
+		}
+	}
+	widths = h.pictureWidths(widths, meta.Width)
+
+	p := picture{
+		Width:  widths[len(widths)-1],
+		Height: meta.Height * widths[len(widths)-1] / meta.Width,
+		Sizes:  q.Get("sizes"),
+		Alt:    q.Get("alt"),
+	}
+	for _, format := range formats {
+		src, err := h.pictureSource(r.Context(), req, format, widths)
+		if err != nil {
+			writeError(tw, r, err)
+			return
+		}
+		p.Sources = append(p.Sources, src)
+	}
+	fallback := p.Sources[len(p.Sources)-1]
+	p.Src = fallback.URLs[len(fallback.URLs)-1].URL
+
+	if q.Get("placeholder") != "false" {
+		if p.Placeholder, err = h.cachedPlaceholder(r, ref, data); err != nil {
+			writeError(tw, r, err)
+			return
+		}
+	}
+
+	var html strings.Builder
+	if err := pictureTemplate.Execute(&html, struct {
+		picture
+		Alternatives []pictureSource
+		Fallback     pictureSource
+		Placeholder  template.URL // Data URL generated by the server
+	}{p, p.Sources[:len(p.Sources)-1], fallback, template.URL(p.Placeholder)}); err != nil {
+		writeError(tw, r, fmt.Errorf("%w: %w", errTransform, err))
+		return
+	}
+	p.HTML = html.String()
+
+	if q.Get("output") == "html" {
+		tw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		tw.Write([]byte(p.HTML))
+		return
+	}
+	tw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(tw).Encode(p)
+}
+
+// parseWidths parses a comma-separated list of positive widths
+func parseWidths(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var widths []int
+	for _, item := range strings.Split(s, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || width < validate.MinWidth {
+			return nil, errorf(http.StatusBadRequest, "invalid_params", "widths must be whole numbers of at least %d, got %q", validate.MinWidth, item)
+		}
+		widths = append(widths, width)
+	}
+	return widths, nil
+}
+
+// pictureWidths sorts widths, defaulting them and dropping those wider than
+// the source or the handler's limit. At least one width is always left.
+func (h *ImageHandler) pictureWidths(widths []int, sourceWidth int) []int {
+	if len(widths) == 0 {
+		widths = defaultPictureWidths
+	}
+	maxWidth := min(sourceWidth, h.limits().MaxWidth)
+	var kept []int
+	for _, width := range widths {
+		if width <= maxWidth && !slices.Contains(kept, width) {
+			kept = append(kept, width)
+		}
+	}
+	if len(kept) == 0 {
+		kept = []int{maxWidth}
+	}
+	slices.Sort(kept)
+	return kept
+}
+
+// pictureSource generates the rendition URLs of req in format
+func (h *ImageHandler) pictureSource(ctx context.Context, req params.Request, format string, widths []int) (pictureSource, error) {
+	src := pictureSource{Format: format, Type: contentType(format)}
+	var srcset []string
+	for _, width := range widths {
+		rendition := req
+		rendition.Options = transform.Options{Width: width, Format: format, Quality: req.Options.Quality}
+		if err := h.limits().ImageOptions(width, 0, rendition.Options.Quality, format, ""); err != nil {
+			return pictureSource{}, err
+		}
+		// Check presets now, rather than when the URLs are requested
+		check := rendition
+		if err := h.applyPreset(ctx, &check); err != nil {
+			return pictureSource{}, err
+		}
+
+		u, err := h.renditionURL(rendition)
+		if err != nil {
+			return pictureSource{}, newRequestError(http.StatusBadRequest, "invalid_path", err)
+		}
+		src.URLs = append(src.URLs, pictureRendition{Width: width, URL: u})
+		srcset = append(srcset, u+" "+strconv.Itoa(width)+"w")
+	}
+	src.Srcset = strings.Join(srcset, ", ")
+	return src, nil
+}
+
+// renditionURL returns the path API URL of req, signed if the handler signs
+// URLs. API keys are never included.
+func (h *ImageHandler) renditionURL(req params.Request) (string, error) {
+	u, err := url.Parse(h.Prefix + "/img/" + req.EncodePath())
+	if err != nil {
+		return "", err
+	}
+	if h.Signer != nil {
+		h.Signer.Sign(u, time.Time{})
+	}
+	return strings.TrimSuffix(h.PublicURL, "/") + u.String(), nil
+}
+
+// cachedPlaceholder returns the placeholder of an image, sharing the cache
+// entry of placeholder requests with default options
+func (h *ImageHandler) cachedPlaceholder(r *http.Request, ref sourceRef, data []byte) (string, error) {
+	ctx := r.Context()
+	cacheKey := cache.GenerateKey(ref.id, 0, 0, 0, "placeholder", "")
+	if cached, err := h.Cache.Get(ctx, cacheKey); err == nil {
+		return string(cached), nil
+	}
+	placeholder, err := h.placeholder(ctx, data, transform.PlaceholderOptions{})
+	if err != nil {
+		return "", err
+	}
+	h.Cache.Set(ctx, cacheKey, []byte(placeholder))
+	return placeholder, nil
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/clientip"
+	"github.com/deyshin/openimg-go/internal/ratelimit"
+)
+
+// RateLimits limits the requests each client may make. Clients are identified
+// by their API key if they send one, and otherwise by their IP address.
+type RateLimits struct {
+	Hits    *ratelimit.Limiter // Applies to requests served from the cache; nil means no limit
+	Misses  *ratelimit.Limiter // Applies to requests that fetch or render rather than hit the cache; nil means no limit
+	Proxies *clientip.Resolver // Proxies trusted to report client addresses; nil trusts none
+}
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+type clientKey struct{}
+
+// identifyClient returns a copy of r carrying the identity of the client
+// making it, for the hit and miss limits to be checked once it is known
+// whether the request is served from the cache
+func (h *ImageHandler) identifyClient(r *http.Request) *http.Request {
+	if h.RateLimits == nil {
+		return r
+	}
+	client := "ip:" + h.RateLimits.Proxies.ClientIP(r)
+	if key := auth.FromContext(r.Context()); key != nil {
+		client = "key:" + key.ID
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, client))
+}
+
+// limitKey takes a request from the rate limit of the API key in ctx, if
+// there is one. Like limitHit, it sets the RateLimit headers in header unless
+// it is nil.
+func (h *ImageHandler) limitKey(ctx context.Context, header http.Header) error {
+	key := auth.FromContext(ctx)
+	if h.APIKeys == nil || key == nil {
+		return nil
+	}
+	d, err := h.APIKeys.Allow(key, time.Now())
+	setRateLimit(header, d)
+	if err != nil {
+		h.Metrics.observeRateLimited("key")
+	}
+	return err
+}
+
+// limitHit takes a request from the cache hit limit of the client in ctx.
+// The RateLimit headers are set in header unless it is nil, as it is once a
+// response has started.
+func (h *ImageHandler) limitHit(ctx context.Context, header http.Header) error {
+	if h.RateLimits == nil {
+		return nil
+	}
+	client, _ := ctx.Value(clientKey{}).(string)
+	return h.limit(h.RateLimits.Hits, "hits", client, header)
+}
+
+// limitMiss takes a request from the cache miss limit of the client in ctx,
+// like limitHit
+func (h *ImageHandler) limitMiss(ctx context.Context, header http.Header) error {
+	if h.RateLimits == nil {
+		return nil
+	}
+	client, _ := ctx.Value(clientKey{}).(string)
+	return h.limit(h.RateLimits.Misses, "misses", client, header)
+}
+
+func (h *ImageHandler) limit(l *ratelimit.Limiter, name, client string, header http.Header) error {
+	if l == nil || client == "" {
+		return nil
+	}
+	d := l.Allow(client, time.Now())
+	setRateLimit(header, d)
+	if !d.Allowed {
+		h.Metrics.observeRateLimited(name)
+		return fmt.Errorf("%w (%s)", errRateLimited, name)
+	}
+	return nil
+}
+
+// setRateLimit describes a rate limit decision in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, and Retry-After if the
+// request was denied. Several limits may apply to a request, so the headers
+// are only replaced by a limit with fewer requests remaining.
+func setRateLimit(header http.Header, d ratelimit.Decision) {
+	if header == nil || d.Limit == 0 {
+		return
+	}
+	if v := header.Get("RateLimit-Remaining"); v != "" {
+		if remaining, err := strconv.Atoi(v); err == nil && remaining < d.Remaining {
+			return
+		}
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	header.Set("RateLimit-Reset", seconds(d.Reset))
+	if !d.Allowed {
+		header.Set("Retry-After", seconds(max(d.RetryAfter, time.Second)))
+	}
+}
+
+// seconds formats d in whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
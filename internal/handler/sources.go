@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/source"
+	"github.com/deyshin/openimg-go/internal/transform"
+	"github.com/deyshin/openimg-go/internal/validate"
+)
+
+var (
+	errFetch     = errors.New("failed to fetch image")
+	errTransform = errors.New("failed to transform image")
+)
+
+// sourceRef identifies the original image of a request
+type sourceRef struct {
+	source source.Source
+	path   string
+	id     string // Stable identifier used in cache keys
+}
+
+// resolveSource determines the original image of a request, given either as
+// a named source and path (src=local&path=a.jpg) or as a remote URL (url=...)
+func (h *ImageHandler) resolveSource(ctx context.Context, req params.Request) (ref sourceRef, err error) {
+	defer func() { logFrom(ctx).source = ref.id }()
+
+	if name := req.Source; name != "" {
+		src, ok := h.Sources[name]
+		if !ok {
+			return sourceRef{}, errorf(http.StatusBadRequest, "unknown_source", "unknown source %q", name)
+		}
+		if req.Path == "" {
+			return sourceRef{}, errorf(http.StatusBadRequest, "missing_path", "path is required")
+		}
+		return sourceRef{source: src, path: req.Path, id: name + ":" + req.Path}, nil
+	}
+
+	if err := validate.URL(req.URL); err != nil {
+		return sourceRef{}, err
+	}
+	if err := validate.Host(req.URL, h.AllowedOrigins); err != nil {
+		return sourceRef{}, err
+	}
+	if key := auth.FromContext(ctx); key != nil {
+		if err := validate.Host(req.URL, key.AllowedOrigins); err != nil {
+			return sourceRef{}, err
+		}
+	}
+	return sourceRef{source: source.NewHTTP(h.Fetcher), path: req.URL, id: req.URL}, nil
+}
+
+// openSource opens the original image, rejecting it early if its size is
+// known to exceed the handler's limit
+func (h *ImageHandler) openSource(ctx context.Context, ref sourceRef) (*source.Object, error) {
+	var obj *source.Object
+	var err error
+	if h.SourceCache != nil {
+		obj, err = h.SourceCache.Open(ctx, ref.source, ref.id, ref.path)
+	} else {
+		obj, err = ref.source.Open(ctx, ref.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errFetch, err)
+	}
+	if h.MaxSourceBytes > 0 && obj.Size > h.MaxSourceBytes {
+		obj.Body.Close()
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d bytes", errSourceTooLarge, obj.Size, h.MaxSourceBytes)
+	}
+	return obj, nil
+}
+
+// readSource reads the original image, enforcing the handler's source size
+// limit. Decoding happens separately, in the worker pool.
+func (h *ImageHandler) readSource(ctx context.Context, ref sourceRef) ([]byte, source.Info, error) {
+	defer logFrom(ctx).stage("fetch", time.Now())
+	obj, err := h.openSource(ctx, ref)
+	if err != nil {
+		return nil, source.Info{}, err
+	}
+	defer obj.Body.Close()
+
+	data, err := readLimited(obj.Body, h.MaxSourceBytes)
+	if err != nil {
+		if errors.Is(err, errSourceTooLarge) {
+			return nil, source.Info{}, err
+		}
+		return nil, source.Info{}, fmt.Errorf("%w: %w", errFetch, err)
+	}
+	h.Metrics.addSourceBytes(len(data))
+	return data, obj.Info, nil
+}
+
+// decode decodes the original image, enforcing the handler's pixel limit
+func (h *ImageHandler) decode(ctx context.Context, data []byte) (image.Image, string, error) {
+	defer logFrom(ctx).stage("decode", time.Now())
+	img, format, err := transform.Decode(data, h.MaxPixels)
+	if err == nil {
+		err = ctx.Err()
+	}
+	return img, format, err
+}
+
+// process runs CPU-heavy work, such as decoding and encoding, in the worker
+// pool when there is one. Work that hasn't started when ctx is done is skipped.
+func (h *ImageHandler) process(ctx context.Context, fn func() error) error {
+	if h.Pool == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn()
+	}
+	start := time.Now()
+	return h.Pool.Do(ctx, func() error {
+		logFrom(ctx).stage("queue", start)
+		return fn()
+	})
+}
+
+// checkNotModified sets the ETag and Last-Modified headers derived from the
+// source image and reports whether the request's conditional headers allow
+// a 304 response, which it then writes. The ETag combines the source's ETag
+// with variant, so each rendition of a source has its own tag.
+func checkNotModified(w http.ResponseWriter, r *http.Request, info source.Info, variant string) bool {
+	var etag string
+	if info.ETag != "" {
+		sum := sha256.Sum256([]byte(info.ETag + "|" + variant))
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+	}
+	var lastModified time.Time
+	if !info.LastModified.IsZero() {
+		lastModified = info.LastModified.UTC().Truncate(time.Second)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" || !etagMatch(inm, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if lastModified.IsZero() || err != nil || lastModified.After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag,
+// using weak comparison
+func etagMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// renditionHeader is stored before the bytes of a cached rendition, keeping
+// the validators of its source so cache hits answer conditional requests with
+// the same ETag and Last-Modified as misses
+type renditionHeader struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+}
+
+// encodeRendition prepends the validators of info to a rendition for the cache
+func encodeRendition(data []byte, info source.Info) []byte {
+	if info.ETag == "" && info.LastModified.IsZero() {
+		return data
+	}
+	header, err := json.Marshal(renditionHeader{ETag: info.ETag, LastModified: info.LastModified})
+	if err != nil {
+		return data
+	}
+	raw := make([]byte, 0, len(header)+1+len(data))
+	raw = append(raw, header...)
+	raw = append(raw, '\n')
+	return append(raw, data...)
+}
+
+// decodeRendition splits a cached rendition into its bytes and the validators
+// of its source. No image format starts with '{', so entries without a header
+// are returned whole.
+func decodeRendition(raw []byte) ([]byte, source.Info) {
+	if len(raw) == 0 || raw[0] != '{' {
+		return raw, source.Info{}
+	}
+	header, data, ok := bytes.Cut(raw, []byte{'\n'})
+	var h renditionHeader
+	if !ok || json.Unmarshal(header, &h) != nil {
+		return raw, source.Info{}
+	}
+	return data, source.Info{ETag: h.ETag, LastModified: h.LastModified}
+}
+
+// NewSources creates the named sources configured by specs
+func NewSources(specs map[string]string, fetcher *fetch.Fetcher) (map[string]source.Source, error) {
+	sources := make(map[string]source.Source, len(specs))
+	for name, uri := range specs {
+		src, err := source.Parse(uri, fetcher)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", name, err)
+		}
+		sources[name] = src
+	}
+	return sources, nil
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/metadata"
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+// uploadInfo is the JSON body of an upload requesting metadata or a
+// placeholder
+type uploadInfo struct {
+	Metadata    *metadata.ImageMetadata `json:"metadata,omitempty"`
+	Placeholder string                  `json:"placeholder,omitempty"`
+}
+
+// serveUpload transforms an image uploaded with a POST request, either as the
+// raw body or as a multipart/form-data file. With metadata=true and/or
+// placeholder=true, the metadata and placeholder are returned in a single
+// JSON response instead. Uploads are private, so nothing is cached.
+func (h *ImageHandler) serveUpload(w http.ResponseWriter, r *http.Request, req params.Request) {
+	ctx := r.Context()
+	logFrom(ctx).source = "upload"
+	w.Header().Set("Cache-Control", "no-store")
+
+	opts := req.Options
+	if err := h.limits().ImageOptions(opts.Width, opts.Height, opts.Quality, opts.Format, opts.Fit); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Uploads are never cached
+	if err := h.limitMiss(ctx, w.Header()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	start := time.Now()
+	data, err := h.readUpload(r)
+	logFrom(ctx).stage("upload", start)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.Metrics.addSourceBytes(len(data))
+
+	q := r.URL.Query()
+	wantMetadata := req.Mode == params.ModeMetadata
+	wantPlaceholder := req.Mode == params.ModePlaceholder || q.Get("placeholder") == "true"
+	if wantMetadata || wantPlaceholder {
+		h.serveUploadInfo(w, r, data, opts, wantMetadata, wantPlaceholder)
+		return
+	}
+
+	transformed, format, err := h.render(ctx, data, opts)
+	if err != nil {
+		writeError(w, r, uploadError(err))
+		return
+	}
+	w.Header().Set("Content-Type", contentType(format))
+	w.Write(transformed)
+}
+
+func (h *ImageHandler) serveUploadInfo(w http.ResponseWriter, r *http.Request, data []byte, opts transform.Options, wantMetadata, wantPlaceholder bool) {
+	ctx := r.Context()
+	var info uploadInfo
+	if wantMetadata {
+		meta, err := metadata.Get(bytes.NewReader(data))
+		if err != nil {
+			writeError(w, r, uploadError(fmt.Errorf("%w: %w", errDecode, err)))
+			return
+		}
+		info.Metadata = &meta
+	}
+	if wantPlaceholder {
+		var err error
+		info.Placeholder, err = h.placeholder(ctx, data, transform.PlaceholderOptions{
+			Width:   opts.Width,
+			Height:  opts.Height,
+			Quality: opts.Quality,
+		})
+		if err != nil {
+			writeError(w, r, uploadError(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// readUpload reads the uploaded image, enforcing the handler's upload size
+// limit. In a multipart upload, the image is the first file, or the field
+// named "image".
+func (h *ImageHandler) readUpload(r *http.Request) ([]byte, error) {
+	body := io.Reader(r.Body)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, newRequestError(http.StatusBadRequest, "invalid_upload", err)
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, errorf(http.StatusBadRequest, "missing_image", "upload contains no image")
+			}
+			if err != nil {
+				return nil, newRequestError(http.StatusBadRequest, "invalid_upload", err)
+			}
+			if part.FileName() != "" || part.FormName() == "image" {
+				body = part
+				break
+			}
+		}
+	} else if h.MaxUploadBytes > 0 && r.ContentLength > h.MaxUploadBytes {
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d bytes", errSourceTooLarge, r.ContentLength, h.MaxUploadBytes)
+	}
+
+	data, err := readLimited(body, h.MaxUploadBytes)
+	switch {
+	case errors.Is(err, errSourceTooLarge):
+		return nil, err
+	case err != nil:
+		return nil, newRequestError(http.StatusBadRequest, "invalid_upload", err)
+	case len(data) == 0:
+		return nil, errorf(http.StatusBadRequest, "missing_image", "request body is empty")
+	}
+	return data, nil
+}
+
+// uploadError reports images that can't be decoded as the client's fault,
+// rather than the upstream's as for fetched images
+func uploadError(err error) error {
+	if errors.Is(err, errDecode) {
+		return newRequestError(http.StatusUnprocessableEntity, "invalid_image", err)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests served.", "mode", "status")
+	latency := r.Histogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "mode")
+	r.GaugeFunc("queue_depth", "Queued jobs.", func() float64 { return 3 })
+
+	requests.With("image", "200").Inc()
+	requests.With("image", "200").Add(2)
+	requests.With("metadata", "404").Inc()
+	requests.With(`say "hi"`, "500").Inc()
+	latency.With("image").Observe(0.05)
+	latency.With("image").Observe(0.1)
+	latency.With("image").Observe(0.5)
+	latency.With("image").Observe(2)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{mode="image",status="200"} 3
+requests_total{mode="metadata",status="404"} 1
+requests_total{mode="say \"hi\"",status="500"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{mode="image",le="0.1"} 2
+latency_seconds_bucket{mode="image",le="1"} 3
+latency_seconds_bucket{mode="image",le="+Inf"} 4
+latency_seconds_sum{mode="image"} 2.65
+latency_seconds_count{mode="image"} 4
+# HELP queue_depth Queued jobs.
+# TYPE queue_depth gauge
+queue_depth 3
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("metrics output:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
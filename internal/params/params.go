@@ -0,0 +1,213 @@
+// Package params parses image requests from either the query API
+// (/api/image?url=...&w=400) or the path API (/img/w_400,f_webp/<source>)
+// into a common form, so both produce the same cache keys.
+package params
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+const (
+	ModeImage       = ""
+	ModeMetadata    = "metadata"
+	ModePlaceholder = "placeholder"
+)
+
+// Request is a parsed image request
+type Request struct {
+	Mode    string // ModeImage, ModeMetadata or ModePlaceholder
+	URL     string // Remote image URL, when Source is empty
+	Source  string // Named source
+	Path    string // Path within the named source
+	Preset  string // Named preset to expand into Options
+	Options transform.Options
+}
+
+// ParseQuery parses a query API request. Unparsable numbers are treated as
+// unset, as they always have been by the query API.
+func ParseQuery(q url.Values) Request {
+	req := Request{
+		URL:    q.Get("url"),
+		Source: q.Get("src"),
+		Path:   q.Get("path"),
+		Preset: q.Get("preset"),
+	}
+	switch {
+	case q.Get("metadata") == "true":
+		req.Mode = ModeMetadata
+	case q.Get("placeholder") == "true":
+		req.Mode = ModePlaceholder
+	}
+	req.Options.Width, _ = strconv.Atoi(q.Get("w"))
+	req.Options.Height, _ = strconv.Atoi(q.Get("h"))
+	req.Options.Quality, _ = strconv.Atoi(q.Get("q"))
+	req.Options.Format = q.Get("fmt")
+	req.Options.Fit = q.Get("fit")
+	return req
+}
+
+// ParsePath parses the escaped path of a path API request, without its
+// route prefix. The path has the form
+//
+//	<options>/<source>
+//
+// where options is "-" or a comma-separated list of w_<width>, h_<height>,
+// q_<quality>, f_<format>, fit_<fit>, p_<preset>, src_<name>, metadata and
+// placeholder.
+// Without src_<name>, source is a remote URL encoded with unpadded base64url
+// or percent-escaped as a single segment. With src_<name>, source is the path
+// within the named source.
+func ParsePath(escapedPath string) (Request, error) {
+	escapedPath = strings.TrimPrefix(escapedPath, "/")
+	opts, rest, ok := strings.Cut(escapedPath, "/")
+	if !ok || opts == "" || rest == "" {
+		return Request{}, fmt.Errorf("path must be in the form <options>/<source>")
+	}
+
+	var req Request
+	if opts != "-" {
+		for _, opt := range strings.Split(opts, ",") {
+			if err := req.setOption(opt); err != nil {
+				return Request{}, err
+			}
+		}
+	}
+
+	source, err := url.PathUnescape(rest)
+	if err != nil {
+		return Request{}, fmt.Errorf("invalid source encoding: %v", err)
+	}
+	if req.Source != "" {
+		req.Path = source
+		return req, nil
+	}
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req.URL = source
+		return req, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(rest, "="))
+	if err != nil {
+		return Request{}, fmt.Errorf("source must be a base64url or percent-escaped URL")
+	}
+	req.URL = string(decoded)
+	return req, nil
+}
+
+func (req *Request) setOption(opt string) error {
+	switch opt {
+	case ModeMetadata, ModePlaceholder:
+		req.Mode = opt
+		return nil
+	}
+
+	key, value, ok := strings.Cut(opt, "_")
+	if !ok || value == "" {
+		return fmt.Errorf("invalid option %q", opt)
+	}
+	var err error
+	switch key {
+	case "w":
+		req.Options.Width, err = strconv.Atoi(value)
+	case "h":
+		req.Options.Height, err = strconv.Atoi(value)
+	case "q":
+		req.Options.Quality, err = strconv.Atoi(value)
+	case "f":
+		req.Options.Format = value
+	case "fit":
+		req.Options.Fit = value
+	case "p":
+		req.Preset = value
+	case "src":
+		req.Source = value
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for option %q: %s", key, value)
+	}
+	return nil
+}
+
+// EncodePath returns the path API form of req, without the route prefix.
+// It is the inverse of ParsePath.
+func (req Request) EncodePath() string {
+	var opts []string
+	if req.Mode != ModeImage {
+		opts = append(opts, req.Mode)
+	}
+	if req.Preset != "" {
+		opts = append(opts, "p_"+req.Preset)
+	}
+	if req.Options.Width != 0 {
+		opts = append(opts, "w_"+strconv.Itoa(req.Options.Width))
+	}
+	if req.Options.Height != 0 {
+		opts = append(opts, "h_"+strconv.Itoa(req.Options.Height))
+	}
+	if req.Options.Quality != 0 {
+		opts = append(opts, "q_"+strconv.Itoa(req.Options.Quality))
+	}
+	if req.Options.Format != "" {
+		opts = append(opts, "f_"+req.Options.Format)
+	}
+	if req.Options.Fit != "" {
+		opts = append(opts, "fit_"+req.Options.Fit)
+	}
+	if req.Source != "" {
+		opts = append(opts, "src_"+req.Source)
+	}
+	optPath := "-"
+	if len(opts) > 0 {
+		optPath = strings.Join(opts, ",")
+	}
+
+	if req.Source != "" {
+		segments := strings.Split(strings.TrimPrefix(req.Path, "/"), "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		return optPath + "/" + strings.Join(segments, "/")
+	}
+	return optPath + "/" + base64.RawURLEncoding.EncodeToString([]byte(req.URL))
+}
+
+// EncodeQuery returns the query API form of req
+func (req Request) EncodeQuery() url.Values {
+	q := url.Values{}
+	if req.Source != "" {
+		q.Set("src", req.Source)
+		q.Set("path", req.Path)
+	} else {
+		q.Set("url", req.URL)
+	}
+	if req.Mode != ModeImage {
+		q.Set(req.Mode, "true")
+	}
+	if req.Preset != "" {
+		q.Set("preset", req.Preset)
+	}
+	if req.Options.Width != 0 {
+		q.Set("w", strconv.Itoa(req.Options.Width))
+	}
+	if req.Options.Height != 0 {
+		q.Set("h", strconv.Itoa(req.Options.Height))
+	}
+	if req.Options.Quality != 0 {
+		q.Set("q", strconv.Itoa(req.Options.Quality))
+	}
+	if req.Options.Format != "" {
+		q.Set("fmt", req.Options.Format)
+	}
+	if req.Options.Fit != "" {
+		q.Set("fit", req.Options.Fit)
+	}
+	return q
+}
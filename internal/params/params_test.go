@@ -0,0 +1,128 @@
+package params
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+	}{
+		{"remote url", Request{
+			URL:     "https://example.com/images/a.jpg?v=2&size=large",
+			Options: transform.Options{Width: 400, Height: 300, Fit: "cover", Format: "webp", Quality: 80},
+		}},
+		{"no options", Request{URL: "http://example.com/a.png"}},
+		{"named source", Request{
+			Source:  "local",
+			Path:    "products/summer 2024/a+b.jpg",
+			Options: transform.Options{Width: 200},
+		}},
+		{"preset", Request{
+			URL:     "https://example.com/a.jpg",
+			Preset:  "card",
+			Options: transform.Options{Quality: 60},
+		}},
+		{"metadata", Request{Mode: ModeMetadata, URL: "https://example.com/a.jpg"}},
+		{"placeholder", Request{
+			Mode:    ModePlaceholder,
+			URL:     "https://example.com/a.jpg",
+			Options: transform.Options{Width: 20, Quality: 10},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePath(tt.req.EncodePath())
+			if err != nil {
+				t.Fatalf("ParsePath(%q) error = %v", tt.req.EncodePath(), err)
+			}
+			if got != tt.req {
+				t.Errorf("ParsePath(%q) = %+v, want %+v", tt.req.EncodePath(), got, tt.req)
+			}
+
+			if got := ParseQuery(tt.req.EncodeQuery()); got != tt.req {
+				t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.req.EncodeQuery().Encode(), got, tt.req)
+			}
+		})
+	}
+}
+
+func TestPathMatchesQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		query string
+	}{
+		{
+			"base64url source",
+			"w_400,h_300,fit_cover,f_webp,q_80/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw",
+			"url=https://example.com/a.jpg&w=400&h=300&fit=cover&fmt=webp&q=80",
+		},
+		{
+			"padded base64url source",
+			"w_400/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw==",
+			"url=https://example.com/a.jpg&w=400",
+		},
+		{
+			"escaped source",
+			"/h_300,w_400/https%3A%2F%2Fexample.com%2Fa.jpg%3Fv%3D1",
+			"url=" + url.QueryEscape("https://example.com/a.jpg?v=1") + "&w=400&h=300",
+		},
+		{
+			"named source",
+			"src_local,w_100/products/a.jpg",
+			"src=local&path=products/a.jpg&w=100",
+		},
+		{
+			"preset",
+			"p_card,q_60/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw",
+			"url=https://example.com/a.jpg&preset=card&q=60",
+		},
+		{
+			"default options",
+			"-/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw",
+			"url=https://example.com/a.jpg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePath(tt.path)
+			if err != nil {
+				t.Fatalf("ParsePath() error = %v", err)
+			}
+			q, _ := url.ParseQuery(tt.query)
+			if want := ParseQuery(q); got != want {
+				t.Errorf("ParsePath() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"missing source", "w_400"},
+		{"empty options", "/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw"},
+		{"unknown option", "x_1/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw"},
+		{"option without value", "w_/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw"},
+		{"invalid number", "w_abc/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmpwZw"},
+		{"invalid base64", "w_400/not*base64"},
+		{"invalid escape", "w_400/https%3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePath(tt.path); err == nil {
+				t.Errorf("ParsePath(%q) error = nil, want an error", tt.path)
+			}
+		})
+	}
+}
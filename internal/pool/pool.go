@@ -0,0 +1,89 @@
+// Package pool limits how many CPU-heavy jobs, such as image decoding and
+// encoding, run at once.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrBusy is returned when a job is rejected because the pool is
+	// overloaded. The more specific errors below wrap it.
+	ErrBusy = errors.New("server busy")
+
+	ErrQueueFull = fmt.Errorf("%w: queue is full", ErrBusy)
+	ErrTimeout   = fmt.Errorf("%w: timed out waiting for a worker", ErrBusy)
+)
+
+// Pool runs jobs on at most a fixed number of workers. Jobs waiting for a
+// worker are queued, up to a maximum queue size and wait time.
+type Pool struct {
+	workers chan struct{} // Held while a job runs
+	admit   chan struct{} // Held while a job runs or waits
+	maxWait time.Duration
+}
+
+// New creates a pool running up to workers jobs at once, with up to queueSize
+// more waiting for at most maxWait each. A maxWait of zero means no limit.
+func New(workers, queueSize int, maxWait time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &Pool{
+		workers: make(chan struct{}, workers),
+		admit:   make(chan struct{}, workers+queueSize),
+		maxWait: maxWait,
+	}
+}
+
+// Do runs fn once a worker is free and returns its error. It fails with
+// ErrQueueFull without waiting if the queue is full, with ErrTimeout if no
+// worker became free within the maximum wait time, and with the context's
+// error if ctx is done first.
+func (p *Pool) Do(ctx context.Context, fn func() error) error {
+	select {
+	case p.admit <- struct{}{}:
+	default:
+		return ErrQueueFull
+	}
+	defer func() { <-p.admit }()
+
+	var timeout <-chan time.Time
+	if p.maxWait > 0 {
+		timer := time.NewTimer(p.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.workers <- struct{}{}:
+	case <-timeout:
+		return ErrTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.workers }()
+
+	return fn()
+}
+
+// Active returns the number of running jobs
+func (p *Pool) Active() int {
+	return len(p.workers)
+}
+
+// Queued returns the number of jobs waiting for a worker
+func (p *Pool) Queued() int {
+	return max(len(p.admit)-len(p.workers), 0)
+}
+
+// Saturated reports whether the queue is full, so that new jobs would be
+// rejected with ErrQueueFull
+func (p *Pool) Saturated() bool {
+	return len(p.admit) == cap(p.admit)
+}
@@ -0,0 +1,84 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	p := New(2, 1, 50*time.Millisecond)
+
+	// Fill both workers and the queue
+	release := make(chan struct{})
+	running := make(chan struct{}, 2)
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.Do(context.Background(), func() error {
+				running <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	<-running
+	<-running
+	for p.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if p.Active() != 2 {
+		t.Errorf("Active() = %d, want 2", p.Active())
+	}
+	if !p.Saturated() {
+		t.Error("Saturated() = false with a full queue")
+	}
+
+	// A fourth job is rejected straight away
+	if err := p.Do(context.Background(), func() error { return nil }); !errors.Is(err, ErrQueueFull) || !errors.Is(err, ErrBusy) {
+		t.Errorf("Do() with full queue error = %v, want ErrQueueFull", err)
+	}
+
+	// The queued job gives up once it has waited too long
+	if err := <-errs; !errors.Is(err, ErrTimeout) {
+		t.Errorf("queued Do() error = %v, want ErrTimeout", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Do() error = %v", err)
+		}
+	}
+
+	// Waiting stops when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	block := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go p.Do(context.Background(), func() error { <-block; return nil })
+	}
+	for p.Active() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Do(ctx, func() error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() with canceled context error = %v, want context.Canceled", err)
+	}
+	close(block)
+	for p.Active() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The job's own error is returned
+	want := errors.New("failed")
+	if err := p.Do(context.Background(), func() error { return want }); err != want {
+		t.Errorf("Do() error = %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,128 @@
+package preset
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/validate"
+)
+
+var (
+	ErrRequired           = errors.New("a preset is required")
+	ErrUnknown            = errors.New("unknown preset")
+	ErrOverrideNotAllowed = errors.New("preset does not allow overriding")
+)
+
+// Preset is a named set of transformation options. Its fields use the same
+// names as the query parameters they stand for.
+type Preset struct {
+	Width    int      `yaml:"w" json:"w,omitempty"`
+	Height   int      `yaml:"h" json:"h,omitempty"`
+	Quality  int      `yaml:"q" json:"q,omitempty"`
+	Format   string   `yaml:"fmt" json:"fmt,omitempty"`
+	Fit      string   `yaml:"fit" json:"fit,omitempty"`
+	Override []string `yaml:"override" json:"override,omitempty"` // Parameters requests may override
+}
+
+// Set is a collection of presets
+type Set struct {
+	Presets map[string]Preset `yaml:"presets" json:"presets"`
+	Strict  bool              `yaml:"strict" json:"strict"` // Reject requests that do not use a preset
+}
+
+// overridable lists the parameters a preset may allow requests to override
+var overridable = []string{"w", "h", "q", "fmt", "fit"}
+
+// Load reads a preset file. YAML is a superset of JSON, so both formats are
+// accepted.
+func Load(path string) (*Set, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set Set
+	if err := yaml.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid preset file %s: %w", path, err)
+	}
+	if err := set.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid preset file %s: %w", path, err)
+	}
+	return &set, nil
+}
+
+// Validate checks that every preset has valid options
+func (s *Set) Validate() error {
+	for name, p := range s.Presets {
+		if err := validate.ImageOptions(p.Width, p.Height, p.Quality, p.Format, p.Fit); err != nil {
+			return fmt.Errorf("preset %q: %w", name, err)
+		}
+		for _, param := range p.Override {
+			if !contains(overridable, param) {
+				return fmt.Errorf("preset %q: cannot allow overriding %q, must be one of %v", name, param, overridable)
+			}
+		}
+	}
+	return nil
+}
+
+// Apply expands the preset named by req into its options. Options set on the
+// request itself take precedence, but only for parameters the preset allows
+// to be overridden; any other explicit option is an error.
+func (s *Set) Apply(req *params.Request) error {
+	if req.Preset == "" {
+		if s.Strict && req.Mode != params.ModeMetadata {
+			return ErrRequired
+		}
+		return nil
+	}
+
+	p, ok := s.Presets[req.Preset]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknown, req.Preset)
+	}
+
+	opts := req.Options
+	explicit := map[string]bool{
+		"w":   opts.Width != 0,
+		"h":   opts.Height != 0,
+		"q":   opts.Quality != 0,
+		"fmt": opts.Format != "",
+		"fit": opts.Fit != "",
+	}
+	for _, param := range overridable {
+		if explicit[param] && !contains(p.Override, param) {
+			return fmt.Errorf("%w %s: %q", ErrOverrideNotAllowed, param, req.Preset)
+		}
+	}
+
+	if opts.Width == 0 {
+		opts.Width = p.Width
+	}
+	if opts.Height == 0 {
+		opts.Height = p.Height
+	}
+	if opts.Quality == 0 {
+		opts.Quality = p.Quality
+	}
+	if opts.Format == "" {
+		opts.Format = p.Format
+	}
+	if opts.Fit == "" {
+		opts.Fit = p.Fit
+	}
+	req.Options = opts
+	return nil
+}
+
+func contains(slice []string, item string) bool {
+	for _, i := range slice {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package preset
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{"yaml", "presets.yaml", "presets:\n  card:\n    w: 400\n    h: 300\n    fit: cover\n    fmt: webp\n    q: 75\n    override: [q]\n", false},
+		{"json", "presets.json", `{"strict": true, "presets": {"thumb": {"w": 100, "fmt": "jpeg"}}}`, false},
+		{"invalid options", "presets.yaml", "presets:\n  huge:\n    w: 100000\n", true},
+		{"invalid override", "presets.yaml", "presets:\n  card:\n    w: 400\n    override: [url]\n", true},
+		{"malformed", "presets.yaml", "presets: [", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	set := &Set{Presets: map[string]Preset{
+		"card": {Width: 400, Height: 300, Fit: "cover", Format: "webp", Quality: 75, Override: []string{"q"}},
+	}}
+	card := transform.Options{Width: 400, Height: 300, Fit: "cover", Format: "webp", Quality: 75}
+
+	tests := []struct {
+		name    string
+		strict  bool
+		req     params.Request
+		want    transform.Options
+		wantErr error
+	}{
+		{"expand preset", false, params.Request{Preset: "card"}, card, nil},
+		{"allowed override", false,
+			params.Request{Preset: "card", Options: transform.Options{Quality: 50}},
+			transform.Options{Width: 400, Height: 300, Fit: "cover", Format: "webp", Quality: 50}, nil},
+		{"disallowed override", false, params.Request{Preset: "card", Options: transform.Options{Width: 800}}, transform.Options{}, ErrOverrideNotAllowed},
+		{"unknown preset", false, params.Request{Preset: "hero"}, transform.Options{}, ErrUnknown},
+		{"no preset", false, params.Request{Options: transform.Options{Width: 10}}, transform.Options{Width: 10}, nil},
+		{"strict without preset", true, params.Request{Options: transform.Options{Width: 10}}, transform.Options{}, ErrRequired},
+		{"strict with preset", true, params.Request{Preset: "card"}, card, nil},
+		{"strict metadata", true, params.Request{Mode: params.ModeMetadata}, transform.Options{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set.Strict = tt.strict
+			req := tt.req
+			err := set.Apply(&req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Apply() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && req.Options != tt.want {
+				t.Errorf("Apply() options = %+v, want %+v", req.Options, tt.want)
+			}
+		})
+	}
+}
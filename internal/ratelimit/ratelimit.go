@@ -0,0 +1,168 @@
+// Package ratelimit implements token bucket rate limiting
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a sustained rate of events with a burst allowance
+type Limit struct {
+	Rate  float64 // Events per second; 0 or less means no limit
+	Burst int     // Events allowed at once; less than 1 means ceil(Rate)
+}
+
+// Unlimited reports whether l allows any number of events
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// burst returns the bucket's capacity
+func (l Limit) burst() float64 {
+	if l.Burst >= 1 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// Decision is the outcome of taking a token from a bucket
+type Decision struct {
+	Allowed    bool
+	Limit      int           // Capacity of the bucket; 0 if it is unlimited
+	Remaining  int           // Whole tokens left
+	Reset      time.Duration // Until the bucket is full again
+	RetryAfter time.Duration // Until the next token is available, if none is left
+}
+
+// Bucket is a token bucket, refilled at the limit's rate up to its burst. It
+// is safe for concurrent use.
+type Bucket struct {
+	limit Limit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket
+func NewBucket(l Limit) *Bucket {
+	return &Bucket{limit: l, tokens: l.burst()}
+}
+
+// Limit returns the bucket's limit
+func (b *Bucket) Limit() Limit {
+	return b.limit
+}
+
+// Allow takes a token at now if one is available
+func (b *Bucket) Allow(now time.Time) Decision {
+	if b.limit.Unlimited() {
+		return Decision{Allowed: true}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	d := Decision{Limit: int(b.limit.burst())}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = b.until(b.limit.burst())
+	if b.tokens < 1 {
+		d.RetryAfter = b.until(1)
+	}
+	return d
+}
+
+// Full reports whether the bucket has refilled completely by now, so it can
+// be dropped without affecting the limit
+func (b *Bucket) Full(now time.Time) bool {
+	if b.limit.Unlimited() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.limit.burst()
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// until returns how long until the bucket holds tokens
+func (b *Bucket) until(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// sweepInterval is how often a Limiter drops the buckets of idle clients
+const sweepInterval = time.Minute
+
+// Limiter applies a limit to each of many clients, such as IP addresses,
+// with a bucket per client. It is safe for concurrent use.
+type Limiter struct {
+	limit Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewLimiter returns a limiter applying l to each client
+func NewLimiter(l Limit) *Limiter {
+	return &Limiter{limit: l, buckets: map[string]*Bucket{}}
+}
+
+// Limit returns the limit applied to each client
+func (l *Limiter) Limit() Limit {
+	return l.limit
+}
+
+// Allow takes a token from client's bucket at now
+func (l *Limiter) Allow(client string, now time.Time) Decision {
+	if l.limit.Unlimited() {
+		return Decision{Allowed: true}
+	}
+	return l.bucket(client, now).Allow(now)
+}
+
+// Len returns the number of clients being tracked
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func (l *Limiter) bucket(client string, now time.Time) *Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Full buckets are the same as new ones, so dropping them bounds memory
+	// by the number of recently active clients
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		for id, b := range l.buckets {
+			if b.Full(now) {
+				delete(l.buckets, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = NewBucket(l.limit)
+		l.buckets[client] = b
+	}
+	return b
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_Allow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := NewBucket(Limit{Rate: 2, Burst: 3})
+
+	tests := []struct {
+		name string
+		at   time.Duration // Since start
+		want Decision
+	}{
+		{"burst 1", 0, Decision{true, 3, 2, 500 * time.Millisecond, 0}},
+		{"burst 2", 0, Decision{true, 3, 1, time.Second, 0}},
+		{"burst 3", 0, Decision{true, 3, 0, 1500 * time.Millisecond, 500 * time.Millisecond}},
+		{"empty", 0, Decision{false, 3, 0, 1500 * time.Millisecond, 500 * time.Millisecond}},
+		{"partly refilled", 250 * time.Millisecond, Decision{false, 3, 0, 1250 * time.Millisecond, 250 * time.Millisecond}},
+		{"refilled one", 500 * time.Millisecond, Decision{true, 3, 0, 1500 * time.Millisecond, 500 * time.Millisecond}},
+		{"refilled to burst", time.Minute, Decision{true, 3, 2, 500 * time.Millisecond, 0}},
+	}
+
+	for _, tt := range tests {
+		if got := b.Allow(start.Add(tt.at)); got != tt.want {
+			t.Errorf("%s: Allow() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if !b.Full(start.Add(2 * time.Minute)) {
+		t.Error("Full() = false after refilling")
+	}
+
+	if d := NewBucket(Limit{}).Allow(start); !d.Allowed || d.Limit != 0 {
+		t.Errorf("unlimited bucket Allow() = %+v", d)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	l := NewLimiter(Limit{Rate: 1, Burst: 1})
+
+	if !l.Allow("a", start).Allowed || !l.Allow("b", start).Allowed {
+		t.Fatal("first requests of each client denied")
+	}
+	if l.Allow("a", start).Allowed {
+		t.Error("client a allowed over its limit")
+	}
+	if !l.Allow("a", start.Add(time.Second)).Allowed {
+		t.Error("client a denied after refilling")
+	}
+
+	// Idle clients are forgotten
+	l.Allow("c", start.Add(2*sweepInterval))
+	if n := l.Len(); n != 1 {
+		t.Errorf("Len() = %d after idle clients refilled, want 1", n)
+	}
+}
@@ -0,0 +1,174 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/cache"
+)
+
+// Cache keeps the bytes of original images so that several renditions of the
+// same image cost a single read from its source. Entries older than the TTL
+// are revalidated with the source's ETag or modification time when the source
+// supports it, and read again otherwise.
+type Cache struct {
+	cache    cache.Cache
+	ttl      time.Duration
+	maxBytes int64
+	now      func() time.Time
+}
+
+// entry is the metadata stored with the bytes of a cached image
+type entry struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+	Stored       time.Time `json:"stored"`
+}
+
+// NewCache creates a source cache storing images of up to maxBytes bytes in c.
+// Larger images, and those too large for c's entries, are passed through
+// uncached; a maxBytes of zero or less means no limit. Failures to store an
+// image are logged with slog.Default().
+func NewCache(c cache.Cache, ttl time.Duration, maxBytes int64) *Cache {
+	return &Cache{
+		cache:    c,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		now:      time.Now,
+	}
+}
+
+// Close flushes and closes the underlying cache
+func (c *Cache) Close() error {
+	return cache.Close(c.cache)
+}
+
+// Ping checks the underlying cache
+func (c *Cache) Ping(ctx context.Context) error {
+	return cache.Ping(ctx, c.cache)
+}
+
+// Open opens path from src through the cache. id identifies the image across
+// all sources, e.g. its URL.
+func (c *Cache) Open(ctx context.Context, src Source, id, path string) (*Object, error) {
+	key := cache.SourceKey(id)
+	e, data, ok := c.get(ctx, key)
+	if ok && c.now().Sub(e.Stored) < c.ttl {
+		return e.object(data), nil
+	}
+
+	var obj *Object
+	var err error
+	if r, canRevalidate := src.(Revalidator); ok && canRevalidate {
+		obj, err = r.OpenIfChanged(ctx, path, Info{ETag: e.ETag, LastModified: e.LastModified})
+		if errors.Is(err, ErrNotModified) {
+			e.Stored = c.now()
+			c.store(ctx, key, e, data)
+			return e.object(data), nil
+		}
+	} else {
+		obj, err = src.Open(ctx, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.storeObject(ctx, key, obj)
+}
+
+// storeObject reads obj into the cache and returns an equivalent object
+func (c *Cache) storeObject(ctx context.Context, key string, obj *Object) (*Object, error) {
+	if c.maxBytes > 0 && obj.Size > c.maxBytes {
+		return obj, nil
+	}
+
+	var data []byte
+	var err error
+	if c.maxBytes > 0 {
+		data, err = io.ReadAll(io.LimitReader(obj.Body, c.maxBytes+1))
+	} else {
+		data, err = io.ReadAll(obj.Body)
+	}
+	if err != nil {
+		obj.Body.Close()
+		return nil, err
+	}
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		// Too large to cache; hand back what was read followed by the rest
+		obj.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), obj.Body), obj.Body}
+		return obj, nil
+	}
+	obj.Body.Close()
+
+	e := entry{
+		ETag:         obj.ETag,
+		LastModified: obj.LastModified,
+		Stored:       c.now(),
+	}
+	c.store(ctx, key, e, data)
+	return e.object(data), nil
+}
+
+// Entries are stored as a line of JSON metadata followed by the image bytes
+func (c *Cache) get(ctx context.Context, key string) (entry, []byte, bool) {
+	raw, err := c.cache.Get(ctx, key)
+	if err != nil {
+		return entry{}, nil, false
+	}
+	header, data, ok := bytes.Cut(raw, []byte("\n"))
+	if !ok {
+		return entry{}, nil, false
+	}
+	var e entry
+	if err := json.Unmarshal(header, &e); err != nil {
+		return entry{}, nil, false
+	}
+	return e, data, true
+}
+
+// errTooLarge reports an image larger than the backend's entries
+var errTooLarge = errors.New("image is larger than the cache's entries")
+
+// store caches an image. Caching is best effort, so failures are logged
+// rather than returned, except for images the backend can't hold, which it
+// was warned about when it was configured.
+func (c *Cache) store(ctx context.Context, key string, e entry, data []byte) {
+	if err := c.set(ctx, key, e, data); err != nil && !errors.Is(err, errTooLarge) {
+		slog.Default().WarnContext(ctx, "source cache: storing an original failed", "key", key, "bytes", len(data), "error", err)
+	}
+}
+
+func (c *Cache) set(ctx context.Context, key string, e entry, data []byte) error {
+	header, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	size := len(header) + 1 + len(data)
+	if limit := cache.MaxEntrySize(c.cache); limit > 0 && len(key)+size > limit {
+		return fmt.Errorf("%w: %d bytes, limit %d", errTooLarge, len(key)+size, limit)
+	}
+	raw := make([]byte, 0, size)
+	raw = append(raw, header...)
+	raw = append(raw, '\n')
+	raw = append(raw, data...)
+	return c.cache.Set(ctx, key, raw)
+}
+
+func (e entry) object(data []byte) *Object {
+	return &Object{
+		Body: io.NopCloser(bytes.NewReader(data)),
+		Info: Info{
+			Size:         int64(len(data)),
+			ETag:         e.ETag,
+			LastModified: e.LastModified,
+		},
+	}
+}
@@ -0,0 +1,199 @@
+package source
+
+import (
+	"context"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/cache"
+)
+
+// countingSource serves a fixed image and counts full and conditional reads
+type countingSource struct {
+	data        []byte
+	etag        string
+	hideSize    bool // Report the size as unknown, like a chunked response
+	opens       int
+	revalidates int
+	notModified int
+}
+
+func (s *countingSource) Open(ctx context.Context, path string) (*Object, error) {
+	s.opens++
+	size := int64(len(s.data))
+	if s.hideSize {
+		size = -1
+	}
+	return &Object{
+		Body: io.NopCloser(bytes.NewReader(s.data)),
+		Info: Info{Size: size, ETag: s.etag},
+	}, nil
+}
+
+type revalidatingSource struct {
+	*countingSource
+}
+
+func (s revalidatingSource) OpenIfChanged(ctx context.Context, path string, info Info) (*Object, error) {
+	s.revalidates++
+	if info.ETag == s.etag {
+		s.notModified++
+		return nil, ErrNotModified
+	}
+	return s.Open(ctx, path)
+}
+
+func readAll(t *testing.T, obj *Object) string {
+	t.Helper()
+	defer obj.Body.Close()
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	src := &countingSource{data: []byte("original"), etag: `"v1"`}
+	c := NewCache(cache.NewMemoryCache(10, 0), time.Minute, 0)
+	c.now = func() time.Time { return now }
+	rs := revalidatingSource{src}
+
+	// Several reads within the TTL cost a single read from the source
+	for i := 0; i < 3; i++ {
+		obj, err := c.Open(context.Background(), rs, "http://example.com/a.jpg", "http://example.com/a.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, obj); got != "original" {
+			t.Errorf("Open() body = %q, want %q", got, "original")
+		}
+		if obj.ETag != `"v1"` {
+			t.Errorf("Open() ETag = %q, want %q", obj.ETag, `"v1"`)
+		}
+	}
+	if src.opens != 1 || src.revalidates != 0 {
+		t.Errorf("source opened %d times and revalidated %d times, want 1 and 0", src.opens, src.revalidates)
+	}
+
+	// A stale, unchanged entry is revalidated rather than read again
+	now = now.Add(2 * time.Minute)
+	obj, err := c.Open(context.Background(), rs, "http://example.com/a.jpg", "http://example.com/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, obj)
+	if src.opens != 1 || src.notModified != 1 {
+		t.Errorf("source opened %d times with %d not modified, want 1 and 1", src.opens, src.notModified)
+	}
+
+	// A stale, changed entry is read again
+	now = now.Add(2 * time.Minute)
+	src.data, src.etag = []byte("updated"), `"v2"`
+	obj, err = c.Open(context.Background(), rs, "http://example.com/a.jpg", "http://example.com/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, obj); got != "updated" {
+		t.Errorf("Open() body = %q, want %q", got, "updated")
+	}
+	if src.opens != 2 {
+		t.Errorf("source opened %d times, want 2", src.opens)
+	}
+}
+
+func TestCacheWithoutRevalidation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	src := &countingSource{data: []byte("original")}
+	c := NewCache(cache.NewMemoryCache(10, 0), time.Minute, 0)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		obj, err := c.Open(context.Background(), src, "local:a.jpg", "a.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, obj)
+		now = now.Add(2 * time.Minute)
+	}
+	if src.opens != 2 {
+		t.Errorf("source opened %d times, want 2", src.opens)
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	for _, hideSize := range []bool{false, true} {
+		src := &countingSource{data: []byte("too large to cache"), hideSize: hideSize}
+		c := NewCache(cache.NewMemoryCache(10, 0), time.Minute, 4)
+
+		for i := 0; i < 2; i++ {
+			obj, err := c.Open(context.Background(), src, "local:a.jpg", "a.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readAll(t, obj); got != "too large to cache" {
+				t.Errorf("Open() body = %q, want %q", got, "too large to cache")
+			}
+		}
+		if src.opens != 2 {
+			t.Errorf("source opened %d times with hidden size %v, want 2", src.opens, hideSize)
+		}
+	}
+}
+
+// failingCache is a cache backend that rejects every entry
+type failingCache struct {
+	cache.Cache
+}
+
+func (failingCache) Set(ctx context.Context, key string, value []byte) error {
+	return errors.New("backend unavailable")
+}
+
+func TestCacheRealisticOriginal(t *testing.T) {
+	// A typical photo, far over the ~100KB entries of a 100MB memory cache
+	data := bytes.Repeat([]byte{0xff}, 2<<20)
+	logs := new(bytes.Buffer)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+
+	tests := []struct {
+		name      string
+		backend   cache.Cache
+		wantOpens int
+		wantLog   bool
+	}{
+		{"disk", cache.NewDiskCache(t.TempDir()), 1, false},
+		{"memory", cache.NewMemoryCache(100, 0), 3, false},
+		{"failing", failingCache{cache.NewNoopCache()}, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			src := &countingSource{data: data}
+			c := NewCache(tt.backend, time.Minute, 32<<20)
+			for i := 0; i < 3; i++ {
+				obj, err := c.Open(context.Background(), src, "local:a.jpg", "a.jpg")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := readAll(t, obj); len(got) != len(data) {
+					t.Errorf("Open() read %d bytes, want %d", len(got), len(data))
+				}
+			}
+			if src.opens != tt.wantOpens {
+				t.Errorf("source opened %d times, want %d", src.opens, tt.wantOpens)
+			}
+			if got := strings.Contains(logs.String(), "backend unavailable"); got != tt.wantLog {
+				t.Errorf("logged failure = %v, want %v:\n%s", got, tt.wantLog, logs)
+			}
+		})
+	}
+}
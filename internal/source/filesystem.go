@@ -0,0 +1,118 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filesystem reads images from a directory; paths are slash-separated and
+// relative to the root
+type Filesystem struct {
+	root string
+}
+
+// NewFilesystem creates a Filesystem source rooted at dir
+func NewFilesystem(dir string) (*Filesystem, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Resolve symlinks in the root itself so that containment checks compare
+	// like with like
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source root %q: %w", dir, err)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("source root %q is not a directory", dir)
+	}
+	return &Filesystem{root: root}, nil
+}
+
+func (s *Filesystem) Open(ctx context.Context, p string) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return nil, ErrForbidden
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, ErrNotFound
+	}
+
+	return &Object{
+		Body: file,
+		Info: Info{
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		},
+	}, nil
+}
+
+func (s *Filesystem) OpenIfChanged(ctx context.Context, p string, info Info) (*Object, error) {
+	name, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.LastModified.IsZero() {
+		if stat, err := os.Stat(name); err == nil && stat.ModTime().Equal(info.LastModified) {
+			return nil, ErrNotModified
+		}
+	}
+	return s.Open(ctx, p)
+}
+
+// resolve maps p to a file name inside the root, rejecting paths that would
+// escape it either lexically or through symlinks
+func (s *Filesystem) resolve(p string) (string, error) {
+	rel, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(s.root, filepath.FromSlash(rel))
+	resolved, err := filepath.EvalSymlinks(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !within(s.root, resolved) {
+		return "", ErrInvalidPath
+	}
+	return resolved, nil
+}
+
+func within(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,75 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/deyshin/openimg-go/internal/fetch"
+)
+
+// HTTP reads images from remote servers; paths are absolute http(s) URLs
+type HTTP struct {
+	fetcher *fetch.Fetcher
+}
+
+// NewHTTP creates an HTTP source using fetcher
+func NewHTTP(fetcher *fetch.Fetcher) *HTTP {
+	return &HTTP{fetcher: fetcher}
+}
+
+func (s *HTTP) Open(ctx context.Context, path string) (*Object, error) {
+	return s.OpenIfChanged(ctx, path, Info{})
+}
+
+func (s *HTTP) OpenIfChanged(ctx context.Context, path string, info Info) (*Object, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	setConditional(req, info)
+	return responseObject(s.fetcher.Do(req))
+}
+
+// setConditional adds conditional request headers for the validators in info
+func setConditional(req *http.Request, info Info) {
+	if info.ETag != "" {
+		req.Header.Set("If-None-Match", info.ETag)
+	}
+	if !info.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// responseObject converts the result of a fetch into an Object, mapping
+// upstream failures to the source errors
+func responseObject(resp *http.Response, err error) (*Object, error) {
+	switch {
+	case errors.Is(err, fetch.ErrNotModified):
+		return nil, ErrNotModified
+	case errors.Is(err, fetch.ErrNotFound):
+		return nil, fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.Is(err, fetch.ErrForbidden):
+		return nil, fmt.Errorf("%w: %w", ErrForbidden, err)
+	case err != nil:
+		return nil, err
+	}
+
+	return &Object{
+		Body: resp.Body,
+		Info: responseInfo(resp),
+	}, nil
+}
+
+// responseInfo extracts the size and validators of an upstream response
+func responseInfo(resp *http.Response) Info {
+	info := Info{
+		Size: resp.ContentLength,
+		ETag: resp.Header.Get("ETag"),
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lm
+	}
+	return info
+}
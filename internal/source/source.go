@@ -0,0 +1,89 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/fetch"
+)
+
+var (
+	ErrNotFound    = errors.New("source image not found")
+	ErrForbidden   = errors.New("access to source image denied")
+	ErrInvalidPath = errors.New("invalid source path")
+	ErrNotModified = errors.New("source image not modified")
+)
+
+// Info describes a source image
+type Info struct {
+	Size         int64     // Size in bytes, or -1 if unknown
+	ETag         string    // Entity tag as sent by the origin, or empty if unknown
+	LastModified time.Time // Zero if unknown
+}
+
+// Object is an opened source image
+type Object struct {
+	Body io.ReadCloser
+	Info
+}
+
+// Source provides original images by path. Opening stops when ctx is done.
+type Source interface {
+	Open(ctx context.Context, path string) (*Object, error)
+}
+
+// Revalidator is implemented by sources that can check whether an image has
+// changed since it was last read
+type Revalidator interface {
+	// OpenIfChanged opens path, or returns ErrNotModified if the image still
+	// matches the ETag or modification time in info
+	OpenIfChanged(ctx context.Context, path string, info Info) (*Object, error)
+}
+
+// Parse creates a Source from a URI such as file:///mnt/originals or
+// s3://bucket/prefix?region=eu-west-1. A plain path is treated as a
+// filesystem root. Remote sources fetch objects with fetcher.
+func Parse(uri string, fetcher *fetch.Fetcher) (Source, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q: %v", uri, err)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		root := u.Path
+		if u.Scheme == "" {
+			root = uri
+		}
+		return NewFilesystem(root)
+	case "s3":
+		return parseS3(u, fetcher)
+	default:
+		return nil, fmt.Errorf("unsupported source scheme %q", u.Scheme)
+	}
+}
+
+// cleanPath validates a slash-separated source path and returns it cleaned
+// and without a leading slash. Paths containing ".." elements are rejected
+// rather than cleaned, as they are never legitimate.
+func cleanPath(p string) (string, error) {
+	if p == "" || strings.ContainsRune(p, 0) || strings.Contains(p, "\\") {
+		return "", ErrInvalidPath
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if rel == "" {
+		return "", ErrInvalidPath
+	}
+	return rel, nil
+}
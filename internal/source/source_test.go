@@ -0,0 +1,108 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/fetch"
+)
+
+func TestFilesystem(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "products"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "products", "a.jpg"), []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.jpg"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.jpg"), filepath.Join(root, "link.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "products", "a.jpg"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := NewFilesystem(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantErr  error
+		wantBody string
+	}{
+		{"existing file", "products/a.jpg", nil, "image"},
+		{"leading slash", "/products/a.jpg", nil, "image"},
+		{"missing file", "products/b.jpg", ErrNotFound, ""},
+		{"directory", "products", ErrNotFound, ""},
+		{"empty path", "", ErrInvalidPath, ""},
+		{"parent traversal", "../" + filepath.Base(outside) + "/secret.jpg", ErrInvalidPath, ""},
+		{"nested traversal", "products/../../secret.jpg", ErrInvalidPath, ""},
+		{"backslash traversal", "..\\secret.jpg", ErrInvalidPath, ""},
+		{"symlink escape", "link.jpg", ErrInvalidPath, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := src.Open(context.Background(), tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Open() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer obj.Body.Close()
+
+			body, _ := io.ReadAll(obj.Body)
+			if string(body) != tt.wantBody {
+				t.Errorf("Open() body = %q, want %q", body, tt.wantBody)
+			}
+			if obj.Size != int64(len(tt.wantBody)) {
+				t.Errorf("Open() size = %d, want %d", obj.Size, len(tt.wantBody))
+			}
+			if !obj.LastModified.Equal(mtime) {
+				t.Errorf("Open() last modified = %v, want %v", obj.LastModified, mtime)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr bool
+	}{
+		{"file uri", "file://" + dir, false},
+		{"plain path", dir, false},
+		{"missing directory", filepath.Join(dir, "missing"), true},
+		{"s3 bucket", "s3://bucket/prefix?region=eu-west-1", false},
+		{"s3 without bucket", "s3:///prefix", true},
+		{"s3 invalid endpoint", "s3://bucket?endpoint=ftp://example.com", true},
+		{"unsupported scheme", "ftp://example.com/images", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.uri, fetch.New(fetch.DefaultOptions()))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,11 +2,14 @@ package transform
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
+	"io"
 
 	"github.com/disintegration/imaging"
 	"github.com/gen2brain/avif"
@@ -27,6 +30,7 @@ type Options struct {
 	Grayscale bool
 	Blurhash bool // Generate blurhash string
 	Smart    bool // Enable content-aware cropping
+	Speed    int  // AVIF encoder speed 1-10, higher is faster; 0 uses DefaultAVIFSpeed
 }
 
 // PlaceholderOptions represents options for generating image placeholders
@@ -44,33 +48,103 @@ const (
 	FormatWEBP = "webp"
 )
 
+var (
+	ErrDecode        = errors.New("failed to decode image")
+	ErrTooManyPixels = errors.New("source image has too many pixels")
+)
+
 // Add AVIF-specific constants
 const (
 	DefaultAVIFQuality = 85
 	DefaultAVIFSpeed = 8  // Balance between speed and compression
 )
 
+// Codecs returns the supported output formats and the library encoding each.
+// AVIF and WebP use the system's shared libraries when they could be loaded
+// and fall back to slower WebAssembly builds otherwise.
+func Codecs() map[string]string {
+	codecs := map[string]string{
+		FormatJPEG: "go",
+		FormatPNG:  "go",
+		FormatAVIF: "libavif",
+		FormatWEBP: "libwebp",
+	}
+	if avif.Dynamic() != nil {
+		codecs[FormatAVIF] = "wasm"
+	}
+	if webp.Dynamic() != nil {
+		codecs[FormatWEBP] = "wasm"
+	}
+	return codecs
+}
+
 // Transform applies the specified transformations to an image
 func Transform(img image.Image, opts Options) ([]byte, error) {
+	return TransformContext(context.Background(), img, opts)
+}
+
+// TransformContext is like Transform, but gives up between resizing and
+// encoding once ctx is done
+func TransformContext(ctx context.Context, img image.Image, opts Options) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Apply resizing if needed
 	if opts.Width > 0 || opts.Height > 0 {
-		switch opts.Fit {
-		case "cover":
-			img = imaging.Fill(img, opts.Width, opts.Height, imaging.Center, imaging.Lanczos)
-		case "contain":
-			img = imaging.Fit(img, opts.Width, opts.Height, imaging.Lanczos)
-		default:
-			img = imaging.Resize(img, opts.Width, opts.Height, imaging.Lanczos)
-		}
+		img = Resize(img, opts.Width, opts.Height, opts.Fit)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	// Encode the image
 	buf := new(bytes.Buffer)
+	if err := Encode(buf, img, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes data after checking the dimensions in its header, so
+// decompression bombs are rejected before any pixel buffer is allocated.
+// A maxPixels of zero or less means no limit.
+func Decode(data []byte, maxPixels int64) (image.Image, string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); maxPixels > 0 && pixels > maxPixels {
+		return nil, "", fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrTooManyPixels, config.Width, config.Height, maxPixels)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return img, format, nil
+}
+
+// Resize scales img to width x height. With fit "cover" the image is cropped
+// to fill the box, with "contain" it is fitted inside it, and otherwise it is
+// stretched. A zero width or height preserves the aspect ratio.
+func Resize(img image.Image, width, height int, fit string) image.Image {
+	switch fit {
+	case "cover":
+		return imaging.Fill(img, width, height, imaging.Center, imaging.Lanczos)
+	case "contain":
+		return imaging.Fit(img, width, height, imaging.Lanczos)
+	default:
+		return imaging.Resize(img, width, height, imaging.Lanczos)
+	}
+}
+
+// Encode writes img to w in opts.Format, using opts.Quality and opts.Speed.
+// Unknown formats are encoded as PNG.
+func Encode(w io.Writer, img image.Image, opts Options) error {
 	switch opts.Format {
 	case "png":
-		if err := png.Encode(buf, img); err != nil {
-			return nil, err
-		}
+		return png.Encode(w, img)
 	case "avif":
 		quality := opts.Quality
 		if quality == 0 {
@@ -78,39 +152,36 @@ func Transform(img image.Image, opts Options) ([]byte, error) {
 		}
 		// AVIF quality must be between 0 and 63
 		quality = quality * 63 / 100  // Convert from 0-100 scale to 0-63 scale
-		if err := avif.Encode(buf, img, avif.Options{
+		speed := opts.Speed
+		if speed == 0 {
+			speed = DefaultAVIFSpeed
+		}
+		if err := avif.Encode(w, img, avif.Options{
 			Quality: quality,
-			Speed:   DefaultAVIFSpeed,
+			Speed:   speed,
 		}); err != nil {
-			return nil, fmt.Errorf("failed to encode AVIF: %w", err)
+			return fmt.Errorf("failed to encode AVIF: %w", err)
 		}
+		return nil
 	case "webp":
 		quality := opts.Quality
 		if quality == 0 {
 			quality = 85
 		}
-		if err := webp.Encode(buf, img, webp.Options{
+		return webp.Encode(w, img, webp.Options{
 			Lossless: false,
 			Quality:  quality,
-		}); err != nil {
-			return nil, err
-		}
+		})
 	case "jpg", "jpeg":
 		quality := opts.Quality
 		if quality == 0 {
 			quality = 85
 		}
-		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
-			return nil, err
-		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
 	default:
 		// Default to PNG
-		if err := png.Encode(buf, img); err != nil {
-			return nil, err
-		}
+		return png.Encode(w, img)
 	}
-
-	return buf.Bytes(), nil
 }
 
 // GeneratePlaceholder creates a low-quality base64 placeholder
@@ -13,6 +13,14 @@ const (
 	MinHeight = 1
 )
 
+// Default limits on source images, shared by the server configuration and the
+// embeddable handler
+const (
+	DefaultMaxSourceBytes = 32 << 20
+	DefaultMaxUploadBytes = 32 << 20
+	DefaultMaxPixels      = 50_000_000
+)
+
 var ValidFitModes = []string{
 	"cover",
 	"contain",
@@ -21,44 +29,109 @@ var ValidFitModes = []string{
 	"outside",
 }
 
-// ImageOptions validates transformation parameters
+// Error codes
+const (
+	CodeInvalidWidth   = "invalid_width"
+	CodeInvalidHeight  = "invalid_height"
+	CodeInvalidQuality = "invalid_quality"
+	CodeInvalidFormat  = "invalid_format"
+	CodeInvalidFit     = "invalid_fit"
+	CodeMissingURL     = "missing_url"
+	CodeInvalidURL     = "invalid_url"
+	CodeHostNotAllowed = "host_not_allowed"
+)
+
+// Error reports an invalid request parameter
+type Error struct {
+	Code    string // Stable, machine-readable code such as CodeInvalidWidth
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Limits bounds the output dimensions a request may ask for
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+}
+
+// DefaultLimits are the limits used by ImageOptions
+var DefaultLimits = Limits{
+	MaxWidth:  MaxWidth,
+	MaxHeight: MaxHeight,
+}
+
+// ImageOptions validates transformation parameters against DefaultLimits
 func ImageOptions(width, height, quality int, format, fit string) error {
-	if width != 0 && (width < MinWidth || width > MaxWidth) {
-		return fmt.Errorf("width must be between %d and %d", MinWidth, MaxWidth)
+	return DefaultLimits.ImageOptions(width, height, quality, format, fit)
+}
+
+// ImageOptions validates transformation parameters against l. Failures are
+// returned as *Error.
+func (l Limits) ImageOptions(width, height, quality int, format, fit string) error {
+	if width != 0 && (width < MinWidth || width > l.MaxWidth) {
+		return newError(CodeInvalidWidth, "width must be between %d and %d", MinWidth, l.MaxWidth)
 	}
-	if height != 0 && (height < MinHeight || height > MaxHeight) {
-		return fmt.Errorf("height must be between %d and %d", MinHeight, MaxHeight)
+	if height != 0 && (height < MinHeight || height > l.MaxHeight) {
+		return newError(CodeInvalidHeight, "height must be between %d and %d", MinHeight, l.MaxHeight)
 	}
 	if quality != 0 && (quality < 1 || quality > 100) {
-		return fmt.Errorf("quality must be between 1 and 100")
+		return newError(CodeInvalidQuality, "quality must be between 1 and 100")
 	}
 	if format != "" && !isValidFormat(format) {
-		return fmt.Errorf("format must be one of: jpeg, jpg, png, avif, webp")
+		return newError(CodeInvalidFormat, "format must be one of: jpeg, jpg, png, avif, webp")
 	}
 	if fit != "" && !contains(ValidFitModes, fit) {
-		return fmt.Errorf("fit must be one of: %v", ValidFitModes)
+		return newError(CodeInvalidFit, "fit must be one of: %v", ValidFitModes)
 	}
 	return nil
 }
 
-// URL validates the source image URL
+// URL validates the source image URL. Failures are returned as *Error.
 func URL(rawURL string) error {
 	if rawURL == "" {
-		return fmt.Errorf("URL is required")
+		return newError(CodeMissingURL, "URL is required")
 	}
 
 	u, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("invalid URL format: %v", err)
+		return newError(CodeInvalidURL, "invalid URL format: %v", err)
 	}
 
 	if !strings.HasPrefix(u.Scheme, "http") {
-		return fmt.Errorf("URL scheme must be http or https")
+		return newError(CodeInvalidURL, "URL scheme must be http or https")
 	}
 
 	return nil
 }
 
+// Host checks that the host of rawURL is one of allowed. An entry of the
+// form "*.example.com" allows any subdomain of example.com. An empty allowed
+// list allows every host. Failures are returned as *Error.
+func Host(rawURL string, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return newError(CodeInvalidURL, "invalid URL format: %v", err)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == a || (strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:])) {
+			return nil
+		}
+	}
+	return newError(CodeHostNotAllowed, "URL host %q is not allowed", host)
+}
+
 func contains(slice []string, item string) bool {
 	for _, i := range slice {
 		if i == item {
@@ -1,6 +1,9 @@
 package validate
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestImageOptions(t *testing.T) {
 	tests := []struct {
@@ -52,4 +55,82 @@ func TestURL(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{MaxWidth: 500, MaxHeight: 400}
+
+	tests := []struct {
+		name    string
+		width   int
+		height  int
+		wantErr bool
+	}{
+		{"within limits", 500, 400, false},
+		{"width too large", 501, 400, true},
+		{"height too large", 500, 401, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := limits.ImageOptions(tt.width, tt.height, 0, "", "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ImageOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHost(t *testing.T) {
+	allowed := []string{"images.example.com", "*.cdn.example.net"}
+
+	tests := []struct {
+		name    string
+		url     string
+		allowed []string
+		wantErr bool
+	}{
+		{"exact host", "https://images.example.com/a.jpg", allowed, false},
+		{"host with port", "https://images.example.com:8443/a.jpg", allowed, false},
+		{"wildcard subdomain", "https://eu.cdn.example.net/a.jpg", allowed, false},
+		{"wildcard apex", "https://cdn.example.net/a.jpg", allowed, true},
+		{"other host", "https://evil.com/a.jpg", allowed, true},
+		{"suffix trick", "https://images.example.com.evil.com/a.jpg", allowed, true},
+		{"no allowlist", "https://evil.com/a.jpg", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Host(tt.url, tt.allowed)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Host() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode string
+	}{
+		{"width", ImageOptions(MaxWidth+1, 0, 0, "", ""), CodeInvalidWidth},
+		{"height", ImageOptions(0, -1, 0, "", ""), CodeInvalidHeight},
+		{"quality", ImageOptions(0, 0, 101, "", ""), CodeInvalidQuality},
+		{"format", ImageOptions(0, 0, 0, "gif", ""), CodeInvalidFormat},
+		{"fit", ImageOptions(0, 0, 0, "", "stretch"), CodeInvalidFit},
+		{"missing url", URL(""), CodeMissingURL},
+		{"url scheme", URL("ftp://example.com/a.jpg"), CodeInvalidURL},
+		{"host", Host("https://evil.com/a.jpg", []string{"example.com"}), CodeHostNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err *Error
+			if !errors.As(tt.err, &err) || err.Code != tt.wantCode {
+				t.Errorf("error = %#v, want code %q", tt.err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -1,283 +1,121 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"context"
 	"fmt"
-	"image"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/deyshin/openimg-go/internal/cache"
 	"github.com/deyshin/openimg-go/internal/devserver"
-	"github.com/deyshin/openimg-go/internal/metadata"
-	"github.com/deyshin/openimg-go/internal/transform"
-	"github.com/deyshin/openimg-go/internal/validate"
 )
 
 func main() {
-	var cacheOpts string
-	flag.StringVar(&cacheOpts, "cache", "", "Cache configuration (memory:100:4h, /tmp/cache, redis://localhost, or none)")
-	flag.Parse()
-
-	var c cache.Cache
-	switch {
-	case cacheOpts == "none" || cacheOpts == "":
-		c = cache.NewNoopCache()
-	case strings.HasPrefix(cacheOpts, "memory"):
-		// Parse memory:size:ttl format
-		parts := strings.Split(cacheOpts, ":")
-		size := 100 // default 100MB
-		ttl := 4 * time.Hour
-		if len(parts) > 1 {
-			size, _ = strconv.Atoi(parts[1])
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := runSign(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		if len(parts) > 2 {
-			ttl, _ = time.ParseDuration(parts[2])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "process" {
+		if err := runProcess(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		c = cache.NewMemoryCache(size, ttl)
-	default:
-		// Assume it's a disk path
-		c = cache.NewDiskCache(cacheOpts)
+		return
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
+	// Also routes the log package's output through slog
+	slog.SetDefault(newLogger(cfg.Log))
 
 	// Create a new image handler
-	handler := &ImageHandler{
-		Client: &http.Client{},
-		Cache:  c,
+	handler, err := newImageHandler(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Register routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/image", handler.ServeImage)
+	handler.Register(mux)
+	mux.Handle("/metrics", handler.Metrics.Registry)
+	mux.HandleFunc("/healthz", handler.ServeHealth)
+	mux.HandleFunc("/readyz", handler.ServeReady)
+	mux.HandleFunc("/version", handler.ServeVersion)
 
 	// In development mode, serve test files
 	if os.Getenv("GO_ENV") != "production" {
 		log.Printf("Initializing development mode...")
+		_, port, _ := net.SplitHostPort(cfg.Listen)
 		if err := devserver.Setup(mux, port); err != nil {
 			log.Fatal(err)
 		}
 		log.Printf("Development mode initialized")
 	}
 
-	addr := fmt.Sprintf(":%s", port)
-	log.Printf("Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-type ImageHandler struct {
-	Client *http.Client
-	Cache  cache.Cache
-}
-
-func (h *ImageHandler) ServeImage(w http.ResponseWriter, r *http.Request) {
-	// Add CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type")
-
-	if r.Method == http.MethodOptions {
-		return
-	}
-
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
 
-	// Check if metadata is requested
-	if r.URL.Query().Get("metadata") == "true" {
-		h.serveMetadata(w, r)
-		return
-	}
+	// Drain in-flight requests on SIGINT or SIGTERM, then flush the caches
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Check if placeholder is requested
-	if r.URL.Query().Get("placeholder") == "true" {
-		h.servePlaceholder(w, r)
-		return
+	log.Printf("Starting server on %s", ln.Addr())
+	if err := runServer(ctx, newServer(cfg.Server, mux), ln, cfg.Server.ShutdownTimeout); err != nil {
+		log.Printf("Shutdown: %v", err)
 	}
-
-	// Get image URL and transformation parameters
-	imageURL := r.URL.Query().Get("url")
-	if err := validate.URL(imageURL); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Parse transformation options
-	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
-	height, _ := strconv.Atoi(r.URL.Query().Get("h"))
-	quality, _ := strconv.Atoi(r.URL.Query().Get("q"))
-	format := r.URL.Query().Get("fmt")
-	fit := r.URL.Query().Get("fit")
-
-	if err := validate.ImageOptions(width, height, quality, format, fit); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Validate parameters
-	if quality < 1 || quality > 100 {
-		quality = 85 // default quality
+	if err := handler.Close(); err != nil {
+		log.Printf("Flushing caches: %v", err)
 	}
+	log.Printf("Server stopped")
+}
 
-	// Generate cache key
-	cacheKey := cache.GenerateKey(imageURL, width, height, quality, format, fit)
-
-	// Try to get from cache
-	if cached, err := h.Cache.Get(cacheKey); err == nil {
-		contentType := "image/png"
-		switch format {
-		case "jpg", "jpeg":
-			contentType = "image/jpeg"
-		case "png":
-		case "avif":
-			contentType = "image/avif"
-		case "webp":
-			contentType = "image/webp"
+// newCache creates a cache from its command line configuration
+func newCache(opts string) cache.Cache {
+	switch {
+	case opts == "none" || opts == "":
+		return cache.NewNoopCache()
+	case strings.HasPrefix(opts, "memory"):
+		// Parse memory:size:ttl format
+		parts := strings.Split(opts, ":")
+		size := 100 // default 100MB
+		ttl := 4 * time.Hour
+		if len(parts) > 1 {
+			size, _ = strconv.Atoi(parts[1])
 		}
-		w.Header().Set("Content-Type", contentType)
-		w.Write(cached)
-		return
-	}
-
-	// Fetch the image
-	resp, err := h.Client.Get(imageURL)
-	if err != nil {
-		http.Error(w, "Failed to fetch image", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Decode the image
-	img, imgFormat, err := image.Decode(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to decode image", http.StatusBadRequest)
-		return
-	}
-
-	// If format is not specified, use original format
-	if format == "" {
-		format = imgFormat
-	}
-
-	// Transform the image
-	transformed, err := transform.Transform(img, transform.Options{
-		Width:   width,
-		Height:  height,
-		Format:  format,
-		Quality: quality,
-		Fit:     fit,
-	})
-	if err != nil {
-		http.Error(w, "Failed to transform image", http.StatusInternalServerError)
-		return
-	}
-
-	// Set content type based on format
-	contentType := "image/png" // default
-	switch format {
-	case "jpg", "jpeg":
-		contentType = "image/jpeg"
-	case "png":
-	case "avif":
-		contentType = "image/avif"
-	case "webp":
-		contentType = "image/webp"
+		if len(parts) > 2 {
+			ttl, _ = time.ParseDuration(parts[2])
+		}
+		return cache.NewMemoryCache(size, ttl)
+	default:
+		// Assume it's a disk path. Writes happen in the background and are
+		// flushed on shutdown.
+		return cache.NewWriteBackCache(cache.NewDiskCache(opts), 256)
 	}
-
-	// Store in cache
-	h.Cache.Set(cacheKey, transformed)
-
-	w.Header().Set("Content-Type", contentType)
-	w.Write(transformed)
 }
 
-func (h *ImageHandler) serveMetadata(w http.ResponseWriter, r *http.Request) {
-	imageURL := r.URL.Query().Get("url")
-	if err := validate.URL(imageURL); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	resp, err := h.Client.Get(imageURL)
-	if err != nil {
-		http.Error(w, "Failed to fetch image", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	meta, err := metadata.Get(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to get image metadata", http.StatusBadRequest)
-		return
+// cacheBackend names the backend of a cache configuration, see newCache
+func cacheBackend(opts string) string {
+	switch {
+	case opts == "none" || opts == "":
+		return "none"
+	case strings.HasPrefix(opts, "memory"):
+		return "memory"
+	default:
+		return "disk"
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(meta)
 }
-
-func (h *ImageHandler) servePlaceholder(w http.ResponseWriter, r *http.Request) {
-	imageURL := r.URL.Query().Get("url")
-	if err := validate.URL(imageURL); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Parse placeholder options
-	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
-	height, _ := strconv.Atoi(r.URL.Query().Get("h"))
-	quality, _ := strconv.Atoi(r.URL.Query().Get("q"))
-
-	// Generate cache key for placeholder
-	cacheKey := cache.GenerateKey(imageURL, width, height, quality, "placeholder", "")
-
-	// Try to get from cache
-	if cached, err := h.Cache.Get(cacheKey); err == nil {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write(cached)
-		return
-	}
-
-	// Fetch and decode the image
-	resp, err := h.Client.Get(imageURL)
-	if err != nil {
-		http.Error(w, "Failed to fetch image", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	img, _, err := image.Decode(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to decode image", http.StatusBadRequest)
-		return
-	}
-
-	// Generate placeholder
-	placeholder, err := transform.GeneratePlaceholder(img, transform.PlaceholderOptions{
-		Width:   width,
-		Height:  height,
-		Quality: quality,
-	})
-	if err != nil {
-		http.Error(w, "Failed to generate placeholder", http.StatusInternalServerError)
-		return
-	}
-
-	// Store in cache
-	h.Cache.Set(cacheKey, []byte(placeholder))
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(placeholder))
-}
\ No newline at end of file
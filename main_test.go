@@ -1,86 +1,216 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net"
 	"net/http"
-	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/config"
 )
 
-func TestImageHandler_ServeImage(t *testing.T) {
-	handler := &ImageHandler{
-		Client: &http.Client{},
-		Cache:  cache.NewMemoryCache(100, time.Hour),
-	}
+func TestRunServer_GracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
 
-	tests := []struct {
-		name       string
-		url        string
-		wantStatus int
-	}{
-		{
-			name:       "valid request",
-			url:        "/api/image?url=https://picsum.photos/800/600&w=200&h=200",
-			wantStatus: http.StatusOK,
-		},
-		{
-			name:       "missing url",
-			url:        "/api/image?w=200&h=200",
-			wantStatus: http.StatusBadRequest,
-		},
-		{
-			name:       "invalid dimensions",
-			url:        "/api/image?url=https://picsum.photos/800/600&w=5000",
-			wantStatus: http.StatusBadRequest,
-		},
-		{
-			name:       "invalid quality",
-			url:        "/api/image?url=https://picsum.photos/800/600&q=101",
-			wantStatus: http.StatusBadRequest,
-		},
-		{
-			name:       "invalid format",
-			url:        "/api/image?url=https://picsum.photos/800/600&fmt=gif",
-			wantStatus: http.StatusBadRequest,
-		},
-		{
-			name:       "invalid fit",
-			url:        "/api/image?url=https://picsum.photos/800/600&fit=stretch",
-			wantStatus: http.StatusBadRequest,
-		},
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(ctx, newServer(config.Default().Server, mux), ln, 5*time.Second)
+	}()
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("GET", tt.url, nil)
-			w := httptest.NewRecorder()
-			handler.ServeImage(w, req)
+	// Shut down while a request is in flight; it must still complete
+	resp := make(chan *http.Response, 1)
+	go func() {
+		r, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		resp <- r
+	}()
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
 
-			if w.Code != tt.wantStatus {
-				t.Errorf("ServeImage() status = %v, want %v", w.Code, tt.wantStatus)
-			}
-		})
+	if r := <-resp; r == nil || r.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request did not complete: %v", r)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("runServer() error = %v", err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String() + "/slow"); err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestLoadConfig_EmptyMaps(t *testing.T) {
+	// Empty keys unmarshal to nil maps, which the repeatable flags add to
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("sources:\nquality:\nfetch:\n  headers:\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg, err := loadConfig([]string{"-config", path, "-source", "a=" + dir, "-quality", "webp=80", "-fetch-header", "X-Test: 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Sources["a"] != dir || cfg.Quality["webp"] != 80 || cfg.Fetch.Headers["X-Test"] != "1" {
+		t.Errorf("loadConfig() sources = %v, quality = %v, headers = %v", cfg.Sources, cfg.Quality, cfg.Fetch.Headers)
 	}
 }
 
-func TestImageHandler_MethodNotAllowed(t *testing.T) {
-	handler := &ImageHandler{
-		Client: &http.Client{},
-		Cache:  cache.NewMemoryCache(100, time.Hour),
+func TestRunProcess(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a.png", "nested/b.png"} {
+		path := filepath.Join(in, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		png.Encode(f, image.NewRGBA(image.Rect(0, 0, 100, 50)))
+		f.Close()
+	}
+	os.WriteFile(filepath.Join(in, "notes.txt"), []byte("not an image"), 0o644)
+	presets := filepath.Join(t.TempDir(), "presets.yaml")
+	os.WriteFile(presets, []byte("presets:\n  thumb: {w: 20, h: 20, fit: cover, fmt: jpeg}\n"), 0o644)
+
+	args := []string{"-in", in, "-out", out, "-presets", presets, "-widths", "40,80", "-formats", "png,jpeg", "-concurrency", "2"}
+	if err := runProcess(args); err != nil {
+		t.Fatal(err)
+	}
+
+	readManifest := func() manifest {
+		data, err := os.ReadFile(filepath.Join(out, "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := readManifest()
+	if len(m.Images) != 2 {
+		t.Fatalf("manifest has %d images, want 2", len(m.Images))
+	}
+	b := m.Images["nested/b.png"]
+	if b == nil || b.Width != 100 || b.Height != 50 || !strings.HasPrefix(b.Placeholder, "data:image/jpeg;base64,") {
+		t.Fatalf("nested/b.png = %+v", b)
+	}
+	if len(b.Outputs) != 5 {
+		t.Fatalf("nested/b.png has %d outputs, want 5", len(b.Outputs))
+	}
+	for _, want := range []manifestOutput{
+		{Variant: "thumb", Path: "nested/b_thumb.jpg", Width: 20, Height: 20, Format: "jpeg"},
+		{Variant: "w40", Path: "nested/b_w40.png", Width: 40, Height: 20, Format: "png"},
+		{Variant: "w80", Path: "nested/b_w80.jpg", Width: 80, Height: 40, Format: "jpeg"},
+	} {
+		i := slices.IndexFunc(b.Outputs, func(o manifestOutput) bool { return o.Path == want.Path })
+		if i < 0 {
+			t.Errorf("no output %s", want.Path)
+			continue
+		}
+		got := b.Outputs[i]
+		got.Bytes, got.Options = 0, ""
+		if got != want {
+			t.Errorf("output = %+v, want %+v", got, want)
+		}
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(want.Path))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A second run skips up-to-date images and redoes those whose outputs
+	// are missing
+	os.Remove(filepath.Join(out, "a_w40.png"))
+	stale := filepath.Join(out, "nested", "b_w40.png")
+	before, _ := os.Stat(stale)
+	time.Sleep(10 * time.Millisecond)
+	if err := runProcess(args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "a_w40.png")); err != nil {
+		t.Errorf("missing output was not regenerated: %v", err)
+	}
+	if after, _ := os.Stat(stale); !after.ModTime().Equal(before.ModTime()) {
+		t.Error("up-to-date output was regenerated")
+	}
+	if len(readManifest().Images) != 2 {
+		t.Error("resumed run lost manifest entries")
+	}
+
+	// Changing a variant's options regenerates its outputs
+	os.WriteFile(presets, []byte("presets:\n  thumb: {w: 20, h: 20, fit: cover, fmt: jpeg, q: 50}\n"), 0o644)
+	if err := runProcess(args); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(stale); after.ModTime().Equal(before.ModTime()) {
+		t.Error("output of changed variants was not regenerated")
+	}
+
+	if err := runProcess([]string{"-in", in, "-out", out}); err == nil {
+		t.Error("runProcess() without variants succeeded")
+	}
+
+	// Inputs differing only in their extension would overwrite each other,
+	// which is caught before any input is read
+	if err := os.WriteFile(filepath.Join(in, "nested", "b.jpg"), []byte("not read"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runProcess(args); err == nil || !strings.Contains(err.Error(), "nested/b.jpg") {
+		t.Errorf("runProcess() with colliding outputs error = %v", err)
 	}
+}
 
-	methods := []string{"POST", "PUT", "DELETE", "PATCH"}
-	for _, method := range methods {
-		t.Run(method, func(t *testing.T) {
-			req := httptest.NewRequest(method, "/api/image", nil)
-			w := httptest.NewRecorder()
-			handler.ServeImage(w, req)
+func TestProcessVariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		widths  string
+		formats string
+		want    []string
+	}{
+		{"width and format combinations", "40,80", "png,jpeg", []string{"w40 png", "w40 jpeg", "w80 png", "w80 jpeg"}},
+		{"format aliases", "40", "jpeg,jpg", []string{"w40 jpeg"}},
+		{"duplicate widths", "40,040,40", "png", []string{"w40 png"}},
+		{"original size", "", "jpg", []string{"orig jpeg"}},
+	}
 
-			if w.Code != http.StatusMethodNotAllowed {
-				t.Errorf("ServeImage() status = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variants, err := processVariants("", "", tt.widths, tt.formats, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range variants {
+				got = append(got, v.name+" "+v.opts.Format)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("processVariants() = %q, want %q", got, tt.want)
 			}
 		})
 	}
-}
\ No newline at end of file
+}
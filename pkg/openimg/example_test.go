@@ -0,0 +1,88 @@
+package openimg_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/pkg/openimg"
+)
+
+// sample returns a PNG-encoded image of the given size
+func sample(width, height int) []byte {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return buf.Bytes()
+}
+
+func ExamplePipeline() {
+	p := openimg.NewPipeline(openimg.FormatJPEG,
+		openimg.Resize(400, 0, openimg.FitScale),
+		openimg.Grayscale(),
+	)
+	p.Quality = 80
+
+	result, err := p.Process(context.Background(), bytes.NewReader(sample(800, 600)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(result.ContentType(), result.Width, result.Height)
+	// Output: image/jpeg 400 300
+}
+
+func ExampleReadMetadata() {
+	meta, err := openimg.ReadMetadata(bytes.NewReader(sample(640, 480)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s %dx%d %.2f\n", meta.Format, meta.Width, meta.Height, meta.AspectRatio)
+	// Output: png 640x480 1.33
+}
+
+func ExamplePlaceholder() {
+	img, _, err := openimg.Decode(bytes.NewReader(sample(640, 480)), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	placeholder, err := openimg.Placeholder(img, openimg.PlaceholderOptions{Width: 20})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(strings.HasPrefix(placeholder, "data:image/jpeg;base64,"))
+	// Output: true
+}
+
+func ExampleNewHandler() {
+	dir, err := os.MkdirTemp("", "originals")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "photo.png"), sample(800, 600), 0o644)
+
+	h, err := openimg.NewHandler(
+		openimg.WithSource("originals", dir),
+		openimg.WithCache(openimg.NewMemoryCache(64, time.Hour)),
+		openimg.WithLimits(openimg.Limits{MaxWidth: 1200, MaxHeight: 1200}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer h.Close()
+	// Serve it alongside the service's own routes, e.g.
+	// http.Handle("/img/", h)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/img/w_200,f_jpeg,src_originals/photo.png", nil))
+	fmt.Println(w.Code, w.Header().Get("Content-Type"))
+	// Output: 200 image/jpeg
+}
@@ -0,0 +1,434 @@
+package openimg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/auth"
+	"github.com/deyshin/openimg-go/internal/cache"
+	"github.com/deyshin/openimg-go/internal/clientip"
+	"github.com/deyshin/openimg-go/internal/cors"
+	"github.com/deyshin/openimg-go/internal/fetch"
+	"github.com/deyshin/openimg-go/internal/handler"
+	"github.com/deyshin/openimg-go/internal/pool"
+	"github.com/deyshin/openimg-go/internal/ratelimit"
+	"github.com/deyshin/openimg-go/internal/validate"
+	"github.com/deyshin/openimg-go/pkg/signature"
+)
+
+// Cache stores rendered images by key. Get must return an error for missing
+// keys.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// NewMemoryCache returns an in-memory Cache of about sizeMB megabytes whose
+// entries expire after ttl
+func NewMemoryCache(sizeMB int, ttl time.Duration) Cache {
+	return cache.NewMemoryCache(sizeMB, ttl)
+}
+
+// Limits bounds the work a Handler accepts. Zero fields use the defaults of
+// the openimg-go server.
+type Limits struct {
+	MaxWidth       int   // Maximum output width
+	MaxHeight      int   // Maximum output height
+	MaxSourceBytes int64 // Maximum size of a source image
+	MaxUploadBytes int64 // Maximum size of an uploaded image
+	MaxPixels      int64 // Maximum width*height of a source image
+	MaxBatchJobs   int   // Maximum jobs in a batch request
+}
+
+// FetchOptions configures how remote images are fetched
+type FetchOptions struct {
+	Client         *http.Client  // Client to fetch with; nil creates one using the timeouts below
+	ConnectTimeout time.Duration // Time allowed to establish a connection, including TLS
+	ReadTimeout    time.Duration // Time allowed to wait for response headers
+	Timeout        time.Duration // Time allowed for the whole request, including the body
+	Retries        int           // Retries after a network error or 5xx response
+	RetryBackoff   time.Duration // Delay before the first retry, doubled for each further retry
+	MaxRedirects   int           // Redirects to follow; 0 disables redirects
+	Header         http.Header   // Headers sent with every upstream request
+}
+
+// DefaultFetchOptions returns the options used without WithFetcher
+func DefaultFetchOptions() FetchOptions {
+	o := fetch.DefaultOptions()
+	return FetchOptions{
+		ConnectTimeout: o.ConnectTimeout,
+		ReadTimeout:    o.ReadTimeout,
+		Timeout:        o.Timeout,
+		Retries:        o.Retries,
+		RetryBackoff:   o.RetryBackoff,
+		MaxRedirects:   o.MaxRedirects,
+		Header:         o.Header,
+	}
+}
+
+var (
+	// ErrUnauthorized and ErrForbidden are returned by AuthFuncs to reject a
+	// request with 401 Unauthorized or 403 Forbidden
+	ErrUnauthorized = handler.ErrUnauthorized
+	ErrForbidden    = handler.ErrForbidden
+)
+
+// AuthFunc authorizes a request before any work is done for it. Returning an
+// error rejects the request with 401 Unauthorized, or 403 Forbidden if it
+// wraps ErrForbidden; the error's message is sent to the client.
+type AuthFunc func(r *http.Request) error
+
+// RequestInfo describes a request served by a Handler
+type RequestInfo struct {
+	ID       string // Request ID, also sent as X-Request-ID
+	Method   string
+	URI      string // Request URI, with any API key redacted
+	Mode     string // "image", "metadata", "placeholder", "batch" or "picture"
+	Key      string // ID of the API key the request was made with, if any
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+	Source   string                   // Source URL, or <name>:<path> for a named source
+	Cache    string                   // "hit" or "miss", if the cache was consulted
+	Stages   map[string]time.Duration // Time spent in each stage, e.g. fetch and encode
+	Err      error                    // Why the request failed, if it did
+}
+
+// Hooks observe a Handler, e.g. to record metrics or traces. They are called
+// concurrently and should return quickly.
+type Hooks struct {
+	Request func(ctx context.Context, info RequestInfo) // After each request is served
+	Fetch   func(elapsed time.Duration, err error)      // After each attempt to fetch a remote image
+}
+
+// Handler serves the openimg-go image API: /api/image, /api/batch,
+// /api/picture and the path API under /img/, all under an optional prefix
+type Handler struct {
+	srv     *handler.ImageHandler
+	mux     *http.ServeMux
+	fetch   FetchOptions
+	sources map[string]string
+	hooks   Hooks
+}
+
+// Option configures a Handler
+type Option func(*Handler) error
+
+// NewHandler returns a Handler configured by opts. Without options, it fetches
+// remote images from any host, caches nothing, allows cross-origin requests
+// from any origin and applies the server's default limits.
+func NewHandler(opts ...Option) (*Handler, error) {
+	srv := &handler.ImageHandler{
+		Cache:          cache.NewNoopCache(),
+		Limits:         validate.DefaultLimits,
+		MaxSourceBytes: validate.DefaultMaxSourceBytes,
+		MaxUploadBytes: validate.DefaultMaxUploadBytes,
+		MaxPixels:      validate.DefaultMaxPixels,
+		MaxBatchJobs:   1000,
+		BatchWorkers:   runtime.NumCPU(),
+	}
+	h := &Handler{srv: srv, mux: http.NewServeMux(), fetch: DefaultFetchOptions()}
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
+	}
+
+	fetchOpts := fetch.Options{
+		ConnectTimeout: h.fetch.ConnectTimeout,
+		ReadTimeout:    h.fetch.ReadTimeout,
+		Timeout:        h.fetch.Timeout,
+		Retries:        h.fetch.Retries,
+		RetryBackoff:   h.fetch.RetryBackoff,
+		MaxRedirects:   h.fetch.MaxRedirects,
+		Header:         h.fetch.Header,
+		Observe:        h.hooks.Fetch,
+	}
+	if h.fetch.Client != nil {
+		srv.Fetcher = fetch.NewWithClient(h.fetch.Client, fetchOpts)
+	} else {
+		srv.Fetcher = fetch.New(fetchOpts)
+	}
+	sources, err := handler.NewSources(h.sources, srv.Fetcher)
+	if err != nil {
+		return nil, err
+	}
+	srv.Sources = sources
+	if hook := h.hooks.Request; hook != nil {
+		srv.OnRequest = func(ctx context.Context, info handler.RequestInfo) {
+			hook(ctx, RequestInfo(info))
+		}
+	}
+
+	srv.Register(h.mux)
+	return h, nil
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close flushes the handler's cache if it buffers writes
+func (h *Handler) Close() error {
+	return h.srv.Close()
+}
+
+// WithCache caches rendered images in c
+func WithCache(c Cache) Option {
+	return func(h *Handler) error {
+		h.srv.Cache = c
+		return nil
+	}
+}
+
+// WithLimits replaces the default limits. Zero fields keep their defaults.
+func WithLimits(l Limits) Option {
+	return func(h *Handler) error {
+		if l.MaxWidth > 0 {
+			h.srv.Limits.MaxWidth = l.MaxWidth
+		}
+		if l.MaxHeight > 0 {
+			h.srv.Limits.MaxHeight = l.MaxHeight
+		}
+		if l.MaxSourceBytes > 0 {
+			h.srv.MaxSourceBytes = l.MaxSourceBytes
+		}
+		if l.MaxUploadBytes > 0 {
+			h.srv.MaxUploadBytes = l.MaxUploadBytes
+		}
+		if l.MaxPixels > 0 {
+			h.srv.MaxPixels = l.MaxPixels
+		}
+		if l.MaxBatchJobs > 0 {
+			h.srv.MaxBatchJobs = l.MaxBatchJobs
+		}
+		return nil
+	}
+}
+
+// WithAllowedHosts restricts the hosts remote images may be fetched from
+func WithAllowedHosts(hosts ...string) Option {
+	return func(h *Handler) error {
+		h.srv.AllowedOrigins = hosts
+		return nil
+	}
+}
+
+// WithSource adds a named source, selected with the src parameter. uri is a
+// directory, file:// or s3:// URI, as for the server's -source flag.
+func WithSource(name, uri string) Option {
+	return func(h *Handler) error {
+		if h.sources == nil {
+			h.sources = map[string]string{}
+		}
+		h.sources[name] = uri
+		return nil
+	}
+}
+
+// WithFetcher replaces the options remote images and S3 objects are fetched
+// with. Start from DefaultFetchOptions to change only some of them.
+func WithFetcher(opts FetchOptions) Option {
+	return func(h *Handler) error {
+		h.fetch = opts
+		return nil
+	}
+}
+
+// WithPrefix mounts the handler under prefix, e.g. /media for
+// /media/api/image and /media/img/... Generated URLs include the prefix.
+// Register the handler on the parent mux without stripping the prefix:
+//
+//	mux.Handle("/media/", h)
+func WithPrefix(prefix string) Option {
+	return func(h *Handler) error {
+		if prefix != "" && (!strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/")) {
+			return fmt.Errorf("openimg: prefix %q must start and not end with /", prefix)
+		}
+		h.srv.Prefix = prefix
+		return nil
+	}
+}
+
+// CORSPolicy describes the cross-origin requests a Handler allows
+type CORSPolicy struct {
+	// Origins allowed access: exact origins such as https://app.example.com,
+	// patterns with a wildcard subdomain such as https://*.example.com, or *
+	// for any origin
+	AllowedOrigins   []string
+	AllowCredentials bool          // Allow requests with cookies or HTTP authentication
+	AllowedHeaders   []string      // Request headers allowed in preflighted requests; nil allows Accept and Content-Type, and the API key headers with WithAPIKeys
+	ExposedHeaders   []string      // Response headers readable by scripts, e.g. ETag
+	MaxAge           time.Duration // How long browsers may cache preflight responses; 0 leaves it to the browser
+}
+
+// WithCORS restricts cross-origin access to origins, which may be patterns
+// such as https://*.example.com, or "*" for any origin. With no origins, no
+// CORS headers are sent.
+func WithCORS(origins ...string) Option {
+	return WithCORSPolicy(CORSPolicy{AllowedOrigins: append([]string{}, origins...)})
+}
+
+// WithCORSPolicy sets the handler's cross-origin access policy
+func WithCORSPolicy(p CORSPolicy) Option {
+	return func(h *Handler) error {
+		policy := cors.Policy(p)
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("openimg: %w", err)
+		}
+		h.srv.CORS = &policy
+		return nil
+	}
+}
+
+// WithAuth authorizes every request with fn
+func WithAuth(fn AuthFunc) Option {
+	return func(h *Handler) error {
+		h.srv.Authorize = fn
+		return nil
+	}
+}
+
+// APIKey is a key clients authenticate with, sent in the X-API-Key header,
+// as a bearer token or in the key query parameter
+type APIKey struct {
+	ID             string   // Identifies the key's holder in logs and RequestInfo
+	Secret         string   // The key itself, at least 16 characters
+	RateLimit      float64  // Requests per second; 0 means no limit
+	Burst          int      // Requests allowed at once; 0 means ceil(RateLimit)
+	AllowedOrigins []string // Hosts remote images may be fetched from; empty allows all
+	AllowedPresets []string // Presets the key must use; empty allows any request
+}
+
+// WithAPIKeys requires every request to be made with one of keys, or, with
+// WithSigningKeys, signed. Requests without a valid key are rejected with 401
+// Unauthorized, and those over the key's rate limit with 429 Too Many
+// Requests. Picture requests require WithSigningKeys as well, since browsers
+// load the renditions without a key.
+func WithAPIKeys(keys ...APIKey) Option {
+	return func(h *Handler) error {
+		list := make([]auth.Key, len(keys))
+		for i, k := range keys {
+			list[i] = auth.Key(k)
+		}
+		set, err := auth.New(list)
+		if err != nil {
+			return fmt.Errorf("openimg: %w", err)
+		}
+		h.srv.APIKeys = set
+		return nil
+	}
+}
+
+// RateLimit is a sustained request rate per client with a burst allowance
+type RateLimit struct {
+	Rate  float64 // Requests per second; 0 means no limit
+	Burst int     // Requests allowed at once; 0 means ceil(Rate)
+}
+
+// WithRateLimits limits the requests of each client, identified by its API
+// key or IP address. hits applies to requests served from the cache and
+// misses to those that fetch or render an image instead. X-Forwarded-For is
+// only trusted from trustedProxies, given as addresses or CIDR ranges.
+// Limited requests get 429 Too Many Requests with Retry-After and RateLimit
+// headers.
+func WithRateLimits(hits, misses RateLimit, trustedProxies ...string) Option {
+	return func(h *Handler) error {
+		if hits.Rate < 0 || misses.Rate < 0 || hits.Burst < 0 || misses.Burst < 0 {
+			return fmt.Errorf("openimg: rate limits must not be negative")
+		}
+		proxies, err := clientip.New(trustedProxies)
+		if err != nil {
+			return fmt.Errorf("openimg: %w", err)
+		}
+		h.srv.RateLimits = &handler.RateLimits{
+			Hits:    ratelimit.NewLimiter(ratelimit.Limit(hits)),
+			Misses:  ratelimit.NewLimiter(ratelimit.Limit(misses)),
+			Proxies: proxies,
+		}
+		return nil
+	}
+}
+
+// WithHooks observes the handler with hooks
+func WithHooks(hooks Hooks) Option {
+	return func(h *Handler) error {
+		h.hooks = hooks
+		return nil
+	}
+}
+
+// WithSigningKeys requires requests to be signed with one of keys, and signs
+// the URLs the handler generates with the first
+func WithSigningKeys(keys ...[]byte) Option {
+	return func(h *Handler) error {
+		if len(keys) == 0 {
+			return errors.New("openimg: WithSigningKeys requires a key")
+		}
+		h.srv.Verifier = signature.NewVerifier(keys...)
+		h.srv.Signer = signature.NewSigner(keys[0])
+		return nil
+	}
+}
+
+// WithPublicURL sets the base of the URLs the handler generates, e.g.
+// https://img.example.com
+func WithPublicURL(url string) Option {
+	return func(h *Handler) error {
+		h.srv.PublicURL = url
+		return nil
+	}
+}
+
+// WithTimeout sets a deadline for serving each request
+func WithTimeout(d time.Duration) Option {
+	return func(h *Handler) error {
+		h.srv.Timeout = d
+		return nil
+	}
+}
+
+// WithConcurrency limits the images processed at once to workers, with up to
+// queueSize requests waiting at most maxWait for a worker
+func WithConcurrency(workers, queueSize int, maxWait time.Duration) Option {
+	return func(h *Handler) error {
+		if workers <= 0 {
+			return errors.New("openimg: WithConcurrency requires at least one worker")
+		}
+		h.srv.Pool = pool.New(workers, queueSize, maxWait)
+		return nil
+	}
+}
+
+// WithQuality sets the default quality of an output format. "jpg" is the
+// same as "jpeg".
+func WithQuality(format string, quality int) Option {
+	return func(h *Handler) error {
+		if err := validate.ImageOptions(0, 0, quality, format, ""); err != nil {
+			return err
+		}
+		if format == "jpg" {
+			format = FormatJPEG
+		}
+		if h.srv.Quality == nil {
+			h.srv.Quality = map[string]int{}
+		}
+		h.srv.Quality[format] = quality
+		return nil
+	}
+}
+
+// WithLogger writes the access log to logger instead of slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Handler) error {
+		h.srv.Logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,94 @@
+// Package openimg is the Go API of openimg-go, for services that process
+// images in-process instead of calling the server over HTTP.
+//
+// A Pipeline decodes an image, applies a sequence of operations to it and
+// encodes the result. ReadMetadata inspects an image without decoding its
+// pixels, Placeholder generates a tiny inline preview, and NewHandler returns
+// an http.Handler serving the same API as the openimg-go server, configured
+// with functional options.
+//
+// The package follows semantic versioning independently of the server: its
+// exported API only changes incompatibly with a new major Version.
+package openimg
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/deyshin/openimg-go/internal/metadata"
+	"github.com/deyshin/openimg-go/internal/transform"
+)
+
+// Version is the version of this package's API
+const Version = "0.1.0"
+
+// Output formats
+const (
+	FormatJPEG = transform.FormatJPEG
+	FormatPNG  = transform.FormatPNG
+	FormatWebP = transform.FormatWEBP
+	FormatAVIF = transform.FormatAVIF
+)
+
+var (
+	ErrDecode        = transform.ErrDecode
+	ErrTooManyPixels = transform.ErrTooManyPixels
+)
+
+// Metadata describes an image
+type Metadata struct {
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Format      string  `json:"format"`
+	MimeType    string  `json:"mimeType"`
+	AspectRatio float64 `json:"aspectRatio"` // Width divided by height
+}
+
+// ReadMetadata reads the metadata of an image from its header, without
+// decoding its pixels
+func ReadMetadata(r io.Reader) (Metadata, error) {
+	meta, err := metadata.Get(r)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	m := Metadata{
+		Width:    meta.Width,
+		Height:   meta.Height,
+		Format:   meta.Format,
+		MimeType: meta.MimeType,
+	}
+	if m.Height > 0 {
+		m.AspectRatio = float64(m.Width) / float64(m.Height)
+	}
+	return m, nil
+}
+
+// Decode reads and decodes an image, returning it with the name of its
+// format. Images with more than maxPixels pixels are rejected with
+// ErrTooManyPixels before their pixels are decoded; a maxPixels of zero or
+// less means no limit.
+func Decode(r io.Reader, maxPixels int64) (image.Image, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return transform.Decode(data, maxPixels)
+}
+
+// PlaceholderOptions configures Placeholder
+type PlaceholderOptions struct {
+	Width   int // Defaults to 40
+	Height  int // Defaults to preserving the aspect ratio
+	Quality int // 1-100, defaults to 20
+}
+
+// Placeholder returns a tiny, low-quality JPEG version of img as a data URL,
+// for display while the full image loads
+func Placeholder(img image.Image, opts PlaceholderOptions) (string, error) {
+	return transform.GeneratePlaceholder(img, transform.PlaceholderOptions{
+		Width:   opts.Width,
+		Height:  opts.Height,
+		Quality: opts.Quality,
+	})
+}
@@ -0,0 +1,225 @@
+package openimg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPipeline_Process(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		pipeline   Pipeline
+		wantFormat string
+		wantWidth  int
+		wantHeight int
+		wantErr    error
+	}{
+		{"keeps format", context.Background(), Pipeline{}, FormatPNG, 200, 100, nil},
+		{"resize", context.Background(), Pipeline{Ops: []Op{Resize(100, 0, FitScale)}, Format: FormatJPEG}, FormatJPEG, 100, 50, nil},
+		{"cover", context.Background(), Pipeline{Ops: []Op{Resize(50, 50, FitCover)}}, FormatPNG, 50, 50, nil},
+		{"ops in order", context.Background(), Pipeline{Ops: []Op{Rotate(90), Resize(0, 100, FitScale), FlipHorizontal()}}, FormatPNG, 50, 100, nil},
+		{"too many pixels", context.Background(), Pipeline{MaxPixels: 100}, "", 0, 0, ErrTooManyPixels},
+		{"canceled", canceled, Pipeline{Ops: []Op{Grayscale()}}, "", 0, 0, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.pipeline.Process(tt.ctx, bytes.NewReader(buf.Bytes()))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Process() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if result.Format != tt.wantFormat || result.Width != tt.wantWidth || result.Height != tt.wantHeight {
+				t.Errorf("Process() = %s %dx%d, want %s %dx%d", result.Format, result.Width, result.Height, tt.wantFormat, tt.wantWidth, tt.wantHeight)
+			}
+			config, format, err := image.DecodeConfig(bytes.NewReader(result.Data))
+			if err != nil || format != tt.wantFormat || config.Width != tt.wantWidth {
+				t.Errorf("Process() data = %s %dx%d (%v)", format, config.Width, config.Height, err)
+			}
+		})
+	}
+
+	if _, err := (&Pipeline{Format: "gif"}).Process(context.Background(), bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("Process() with an unsupported format succeeded")
+	}
+	if _, err := (&Pipeline{}).Process(context.Background(), bytes.NewReader([]byte("not an image"))); !errors.Is(err, ErrDecode) {
+		t.Errorf("Process() of invalid data error = %v, want %v", err, ErrDecode)
+	}
+}
+
+func TestNewHandler_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"no signing keys", WithSigningKeys()},
+		{"no workers", WithConcurrency(0, 0, 0)},
+		{"invalid quality", WithQuality(FormatJPEG, 101)},
+		{"invalid source", WithSource("bad", "ftp://example.com")},
+		{"invalid prefix", WithPrefix("media/")},
+		{"short API key", WithAPIKeys(APIKey{ID: "team-a", Secret: "short"})},
+		{"invalid trusted proxy", WithRateLimits(RateLimit{Rate: 10}, RateLimit{Rate: 1}, "lb.internal")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewHandler(tt.opt); err == nil {
+				t.Error("NewHandler() succeeded")
+			}
+		})
+	}
+}
+
+func TestNewHandler_DefaultLimits(t *testing.T) {
+	h, err := NewHandler(WithLimits(Limits{MaxPixels: 1000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.srv.MaxSourceBytes; got != 32<<20 {
+		t.Errorf("MaxSourceBytes = %d, want %d", got, 32<<20)
+	}
+	if got := h.srv.MaxPixels; got != 1000 {
+		t.Errorf("MaxPixels = %d, want 1000", got)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 50, 50))); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/image?w=10&fmt=png", buf)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "too_many_pixels") {
+		t.Errorf("upload of a 50x50 image with MaxPixels 1000: status = %v: %s", w.Code, w.Body)
+	}
+}
+
+func TestNewHandler_QualityAlias(t *testing.T) {
+	h, err := NewHandler(WithQuality("jpg", 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.srv.Quality[FormatJPEG]; got != 60 {
+		t.Errorf("WithQuality(\"jpg\", 60) set jpeg quality %d, want 60", got)
+	}
+}
+
+func TestNewHandler_Embedded(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 100, 100)))
+	f.Close()
+
+	var mu sync.Mutex
+	var infos []RequestInfo
+	h, err := NewHandler(
+		WithPrefix("/media"),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithSource("local", dir),
+		WithCORS("https://app.example.com"),
+		WithAuth(func(r *http.Request) error {
+			switch r.Header.Get("Authorization") {
+			case "":
+				return errors.New("missing credentials")
+			case "Bearer readonly":
+				return fmt.Errorf("%w: token cannot read images", ErrForbidden)
+			}
+			return nil
+		}),
+		WithHooks(Hooks{Request: func(ctx context.Context, info RequestInfo) {
+			mu.Lock()
+			infos = append(infos, info)
+			mu.Unlock()
+		}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/media/", h)
+
+	tests := []struct {
+		name       string
+		url        string
+		auth       string
+		origin     string
+		wantStatus int
+		wantCORS   string
+	}{
+		{"path API", "/media/img/w_50,f_png,src_local/a.png", "Bearer ok", "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"query API", "/media/api/image?src=local&path=a.png&w=50", "Bearer ok", "https://evil.example.com", http.StatusOK, ""},
+		{"unauthorized", "/media/img/w_50,src_local/a.png", "", "", http.StatusUnauthorized, ""},
+		{"forbidden", "/media/img/w_50,src_local/a.png", "Bearer readonly", "", http.StatusForbidden, ""},
+		{"outside prefix", "/img/w_50,src_local/a.png", "Bearer ok", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantCORS {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantCORS)
+			}
+		})
+	}
+
+	mu.Lock()
+	if len(infos) != 4 {
+		t.Fatalf("Request hook called %d times, want 4", len(infos))
+	}
+	if got := infos[0]; got.Status != http.StatusOK || got.Mode != "image" || got.Source != "local:a.png" || got.Stages["encode"] == 0 {
+		t.Errorf("RequestInfo = %+v", got)
+	}
+	mu.Unlock()
+
+	// Generated URLs include the prefix
+	req := httptest.NewRequest(http.MethodGet, "/media/api/picture?src=local&path=a.png&widths=50&formats=png&placeholder=false", nil)
+	req.Header.Set("Authorization", "Bearer ok")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var picture struct{ Src string }
+	if err := json.Unmarshal(w.Body.Bytes(), &picture); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if !strings.HasPrefix(picture.Src, "/media/img/") {
+		t.Errorf("picture src = %q, want it under /media/img/", picture.Src)
+	}
+}
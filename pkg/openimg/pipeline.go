@@ -0,0 +1,162 @@
+package openimg
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/deyshin/openimg-go/internal/transform"
+	"github.com/deyshin/openimg-go/internal/validate"
+	"github.com/disintegration/imaging"
+)
+
+// Fit modes of Resize
+const (
+	FitScale   = ""        // Stretch to the box
+	FitCover   = "cover"   // Crop to fill the box
+	FitContain = "contain" // Fit inside the box
+)
+
+// Op is an operation of a Pipeline, returning a transformed copy of an image
+type Op func(image.Image) image.Image
+
+// Resize scales an image to width x height using fit. A zero width or height
+// preserves the aspect ratio.
+func Resize(width, height int, fit string) Op {
+	return func(img image.Image) image.Image {
+		return transform.Resize(img, width, height, fit)
+	}
+}
+
+// Blur applies a Gaussian blur of the given sigma
+func Blur(sigma float64) Op {
+	return func(img image.Image) image.Image {
+		return imaging.Blur(img, sigma)
+	}
+}
+
+// Sharpen sharpens an image with the given sigma
+func Sharpen(sigma float64) Op {
+	return func(img image.Image) image.Image {
+		return imaging.Sharpen(img, sigma)
+	}
+}
+
+// Rotate rotates an image counter-clockwise by the given angle in degrees,
+// filling uncovered areas with transparency
+func Rotate(degrees float64) Op {
+	return func(img image.Image) image.Image {
+		return imaging.Rotate(img, degrees, color.Transparent)
+	}
+}
+
+// FlipHorizontal mirrors an image left to right
+func FlipHorizontal() Op {
+	return func(img image.Image) image.Image {
+		return imaging.FlipH(img)
+	}
+}
+
+// FlipVertical mirrors an image top to bottom
+func FlipVertical() Op {
+	return func(img image.Image) image.Image {
+		return imaging.FlipV(img)
+	}
+}
+
+// Grayscale removes the colors of an image
+func Grayscale() Op {
+	return func(img image.Image) image.Image {
+		return imaging.Grayscale(img)
+	}
+}
+
+// Pipeline decodes an image, applies its operations in order and encodes the
+// result. The zero Pipeline re-encodes an image in its own format.
+type Pipeline struct {
+	Ops       []Op
+	Format    string // Output format; empty keeps the source's format
+	Quality   int    // 1-100; 0 uses the format's default
+	AVIFSpeed int    // AVIF encoder speed 1-10, higher is faster; 0 uses the encoder's default
+	MaxPixels int64  // Maximum width*height of a source image; 0 means no limit
+}
+
+// Result is an image encoded by a Pipeline
+type Result struct {
+	Data   []byte
+	Format string
+	Width  int
+	Height int
+}
+
+// ContentType returns the media type of the result
+func (r *Result) ContentType() string {
+	if r.Format == transform.FormatJPG {
+		return "image/jpeg"
+	}
+	return "image/" + r.Format
+}
+
+// NewPipeline returns a Pipeline applying ops and encoding in format
+func NewPipeline(format string, ops ...Op) *Pipeline {
+	return &Pipeline{Ops: ops, Format: format}
+}
+
+// Process decodes the image read from r, applies the pipeline's operations
+// and encodes the result. It gives up between operations once ctx is done.
+func (p *Pipeline) Process(ctx context.Context, r io.Reader) (*Result, error) {
+	if err := validate.DefaultLimits.ImageOptions(0, 0, p.Quality, p.Format, ""); err != nil {
+		return nil, err
+	}
+	img, format, err := Decode(r, p.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+	if p.Format != "" {
+		format = p.Format
+	}
+	img, err = p.Apply(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.encode(buf, img, format); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Data:   buf.Bytes(),
+		Format: format,
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}, nil
+}
+
+// Apply applies the pipeline's operations to a decoded image
+func (p *Pipeline) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	for _, op := range p.Ops {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		img = op(img)
+	}
+	return img, ctx.Err()
+}
+
+// Encode writes img to w in the pipeline's format, or PNG if it has none
+func (p *Pipeline) Encode(w io.Writer, img image.Image) error {
+	if err := validate.DefaultLimits.ImageOptions(0, 0, p.Quality, p.Format, ""); err != nil {
+		return err
+	}
+	return p.encode(w, img, p.Format)
+}
+
+func (p *Pipeline) encode(w io.Writer, img image.Image, format string) error {
+	return transform.Encode(w, img, transform.Options{
+		Format:  format,
+		Quality: p.Quality,
+		Speed:   p.AVIFSpeed,
+	})
+}
@@ -0,0 +1,87 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	signer := NewSigner([]byte("secret"))
+	signed, err := signer.SignURL("/api/image?w=200&url=https://example.com/a.jpg&h=100", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keys    []string
+		url     string
+		wantErr error
+	}{
+		{"valid signature", []string{"secret"}, signed, nil},
+		{"rotated keys", []string{"new", "secret"}, signed, nil},
+		{"unknown key", []string{"other"}, signed, ErrInvalid},
+		{"missing signature", []string{"secret"}, "/api/image?w=200", ErrMissing},
+		{"tampered query", []string{"secret"}, signed + "&q=10", ErrInvalid},
+		{"malformed signature", []string{"secret"}, "/api/image?w=200&sig=!!", ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys [][]byte
+			for _, k := range tt.keys {
+				keys = append(keys, []byte(k))
+			}
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := NewVerifier(keys...).Verify(u); err != tt.wantErr {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer := NewSigner([]byte("secret"))
+	verifier := NewVerifier([]byte("secret"))
+	verifier.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		expires time.Time
+		wantErr error
+	}{
+		{"not expired", now.Add(time.Minute), nil},
+		{"expired", now.Add(-time.Minute), ErrExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse("/api/image?url=https://example.com/a.jpg")
+			signer.Sign(u, tt.expires)
+			if err := verifier.Verify(u); err != tt.wantErr {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+
+			// Extending the expiry must invalidate the signature
+			q := u.Query()
+			q.Set(ParamExpires, "9999999999")
+			u.RawQuery = q.Encode()
+			if err := verifier.Verify(u); err != ErrInvalid {
+				t.Errorf("Verify() with altered expiry error = %v, want %v", err, ErrInvalid)
+			}
+		})
+	}
+}
+
+func TestCanonicalIgnoresParameterOrder(t *testing.T) {
+	a, _ := url.Parse("/api/image?w=1&h=2&sig=x")
+	b, _ := url.Parse("/api/image?h=2&w=1")
+	if Canonical(a) != Canonical(b) {
+		t.Errorf("Canonical() = %q and %q, want equal", Canonical(a), Canonical(b))
+	}
+}
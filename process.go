@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/deyshin/openimg-go/internal/params"
+	"github.com/deyshin/openimg-go/internal/preset"
+	"github.com/deyshin/openimg-go/internal/transform"
+	"github.com/deyshin/openimg-go/internal/validate"
+)
+
+// processExtensions are the input file extensions the process subcommand
+// picks up
+var processExtensions = []string{".jpg", ".jpeg", ".png", ".webp", ".avif"}
+
+// manifest records the outputs of the process subcommand, keyed by input path
+// relative to the input directory. It is also what makes runs resumable.
+type manifest struct {
+	Images map[string]*manifestImage `json:"images"`
+}
+
+// manifestImage describes an input image and its outputs
+type manifestImage struct {
+	Width       int              `json:"width"`
+	Height      int              `json:"height"`
+	Format      string           `json:"format"`
+	Placeholder string           `json:"placeholder,omitempty"`
+	Size        int64            `json:"size"`    // Size of the input, to detect changes
+	ModTime     time.Time        `json:"modTime"` // Modification time of the input, to detect changes
+	Outputs     []manifestOutput `json:"outputs"`
+}
+
+// manifestOutput describes an output file
+type manifestOutput struct {
+	Variant string `json:"variant"` // Preset name, or w<width> for a width
+	Options string `json:"options"` // Hash of the variant's options, to detect changes
+	Path    string `json:"path"`    // Relative to the output directory
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Format  string `json:"format"`
+	Bytes   int    `json:"bytes"`
+}
+
+// variant is an output to generate from every input
+type variant struct {
+	name string
+	opts transform.Options
+}
+
+// manifestInterval is how many images are processed between writes of the
+// manifest, so an interrupted or killed run loses little work
+const manifestInterval = 10
+
+// hash identifies the options of v, so outputs are regenerated when a preset
+// or flag changes them
+func (v variant) hash() string {
+	data, _ := json.Marshal(v.opts)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// processJob is an input image to process
+type processJob struct {
+	rel  string
+	info fs.FileInfo
+}
+
+// runProcess implements the "process" subcommand, which transforms every image
+// in a directory tree without running a server. Inputs whose manifest entry is
+// up to date and whose outputs exist are skipped, so an interrupted run can
+// be resumed.
+func runProcess(args []string) error {
+	flags := flag.NewFlagSet("process", flag.ContinueOnError)
+	in := flags.String("in", "", "Input directory")
+	out := flags.String("out", "", "Output directory")
+	manifestPath := flags.String("manifest", "", "Manifest path (default <out>/manifest.json)")
+	presetFile := flags.String("presets", "", "YAML or JSON preset file")
+	presetNames := flags.String("preset", "", "Comma-separated presets to apply (default all presets in -presets)")
+	widths := flags.String("widths", "", "Comma-separated output widths")
+	formats := flags.String("formats", "", "Comma-separated output formats (default the input's format)")
+	quality := flags.Int("q", 0, "Output quality (0 for the format's default)")
+	placeholder := flags.Bool("placeholder", true, "Include a placeholder for each image in the manifest")
+	concurrency := flags.Int("concurrency", runtime.NumCPU(), "Images processed at once")
+	force := flags.Bool("force", false, "Process images even if their outputs are up to date")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: openimg-go process -in DIR -out DIR [-presets FILE] [-preset NAMES] [-widths LIST] [-formats LIST]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" || *out == "" {
+		flags.Usage()
+		return errors.New("process: -in and -out are required")
+	}
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(*out, "manifest.json")
+	}
+
+	variants, err := processVariants(*presetFile, *presetNames, *widths, *formats, *quality)
+	if err != nil {
+		return fmt.Errorf("process: %w", err)
+	}
+
+	m := &manifest{Images: map[string]*manifestImage{}}
+	if data, err := os.ReadFile(*manifestPath); err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return fmt.Errorf("process: invalid manifest %s: %w", *manifestPath, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("process: %w", err)
+	}
+
+	var jobs []processJob
+	bases := map[string]string{} // Input by output base, to catch inputs writing the same files
+	err = filepath.WalkDir(*in, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !slices.Contains(processExtensions, strings.ToLower(filepath.Ext(path))) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(*in, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if other, ok := bases[outputBase(rel)]; ok {
+			return fmt.Errorf("%s and %s would write the same outputs; rename one of them", other, rel)
+		}
+		bases[outputBase(rel)] = rel
+		if !*force && m.upToDate(*out, rel, info, variants) {
+			return nil
+		}
+		jobs = append(jobs, processJob{rel: rel, info: info})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("process: %w", err)
+	}
+
+	// Stop taking new images on SIGINT or SIGTERM, but keep what is done
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var mu sync.Mutex
+	var errs []error
+	processed := 0
+	queue := make(chan processJob)
+	var wg sync.WaitGroup
+	for range max(*concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				img, err := processImage(*in, *out, job, variants, *placeholder)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", job.rel, err))
+				} else {
+					m.Images[job.rel] = img
+					processed++
+					if processed%manifestInterval == 0 {
+						// A failed write is retried by the next one, and
+						// reported by the last
+						m.write(*manifestPath)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := m.write(*manifestPath); err != nil {
+		errs = append(errs, err)
+	}
+	fmt.Fprintf(os.Stderr, "Processed %d of %d image(s) needing work\n", processed, len(jobs))
+	if ctx.Err() != nil {
+		errs = append(errs, errors.New("interrupted; run again to resume"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("process: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// processVariants returns the outputs to generate for each input: one per
+// preset, and one per combination of width and format
+func processVariants(presetFile, presetNames, widths, formats string, quality int) ([]variant, error) {
+	var variants []variant
+	if presetFile != "" {
+		set, err := preset.Load(presetFile)
+		if err != nil {
+			return nil, err
+		}
+		names := splitItems(presetNames)
+		if len(names) == 0 {
+			for name := range set.Presets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			req := params.Request{Preset: name}
+			if err := set.Apply(&req); err != nil {
+				return nil, err
+			}
+			if req.Options.Quality == 0 {
+				req.Options.Quality = quality
+			}
+			req.Options.Format = normalizeFormat(req.Options.Format)
+			variants = append(variants, variant{name: name, opts: req.Options})
+		}
+	} else if presetNames != "" {
+		return nil, errors.New("-preset requires -presets")
+	}
+
+	// jpg and jpeg are the same format, written to the same files
+	var formatList []string
+	for _, format := range splitItems(formats) {
+		if format = normalizeFormat(format); !slices.Contains(formatList, format) {
+			formatList = append(formatList, format)
+		}
+	}
+	if len(formatList) == 0 {
+		formatList = []string{""} // The input's format
+	}
+	widthList := splitItems(widths)
+	if len(widthList) == 0 {
+		switch {
+		case formats != "":
+			widthList = []string{"0"} // The input's width
+		case len(variants) == 0:
+			return nil, errors.New("nothing to do; give -presets, -widths or -formats")
+		}
+	}
+	var seen []int
+	for _, w := range widthList {
+		width, err := strconv.Atoi(w)
+		if err != nil {
+			return nil, fmt.Errorf("invalid width %q", w)
+		}
+		if slices.Contains(seen, width) {
+			continue
+		}
+		seen = append(seen, width)
+		for _, format := range formatList {
+			name := "w" + strconv.Itoa(width)
+			if width == 0 {
+				name = "orig"
+			}
+			variants = append(variants, variant{name: name, opts: transform.Options{Width: width, Format: format, Quality: quality}})
+		}
+	}
+
+	for _, v := range variants {
+		o := v.opts
+		if o.Width == 0 {
+			// The input's width, which is only known once it is read
+			o.Width = validate.MinWidth
+		}
+		if err := validate.DefaultLimits.ImageOptions(o.Width, o.Height, o.Quality, o.Format, o.Fit); err != nil {
+			return nil, fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	return variants, nil
+}
+
+// processImage transforms the input image of job into every variant
+func processImage(in, out string, job processJob, variants []variant, withPlaceholder bool) (*manifestImage, error) {
+	data, err := os.ReadFile(filepath.Join(in, filepath.FromSlash(job.rel)))
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := transform.Decode(data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &manifestImage{
+		Width:   img.Bounds().Dx(),
+		Height:  img.Bounds().Dy(),
+		Format:  format,
+		Size:    job.info.Size(),
+		ModTime: job.info.ModTime(),
+	}
+	if withPlaceholder {
+		if result.Placeholder, err = transform.GeneratePlaceholder(img, transform.PlaceholderOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	base := outputBase(job.rel)
+	for _, v := range variants {
+		opts := v.opts
+		if opts.Format == "" {
+			opts.Format = format
+		}
+		encoded, err := transform.Transform(img, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", v.name, err)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", v.name, err)
+		}
+
+		rel := base + "_" + v.name + "." + outputExtension(opts.Format)
+		path := filepath.Join(out, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, encoded, 0o644); err != nil {
+			return nil, err
+		}
+		result.Outputs = append(result.Outputs, manifestOutput{
+			Variant: v.name,
+			Options: v.hash(),
+			Path:    rel,
+			Width:   config.Width,
+			Height:  config.Height,
+			Format:  opts.Format,
+			Bytes:   len(encoded),
+		})
+	}
+	return result, nil
+}
+
+// outputBase returns the path outputs of the input at rel are named after,
+// which is rel without its extension
+func outputBase(rel string) string {
+	return strings.TrimSuffix(rel, filepath.Ext(rel))
+}
+
+// normalizeFormat returns the canonical name of an output format
+func normalizeFormat(format string) string {
+	if format == transform.FormatJPG {
+		return transform.FormatJPEG
+	}
+	return format
+}
+
+// outputExtension returns the file extension of an output format
+func outputExtension(format string) string {
+	if format == transform.FormatJPEG {
+		return "jpg"
+	}
+	return format
+}
+
+// upToDate reports whether the outputs of an input recorded in the manifest
+// match the input and the requested variants, and still exist
+func (m *manifest) upToDate(out, rel string, info fs.FileInfo, variants []variant) bool {
+	img, ok := m.Images[rel]
+	if !ok || img.Size != info.Size() || !img.ModTime.Equal(info.ModTime()) || len(img.Outputs) != len(variants) {
+		return false
+	}
+	for i, output := range img.Outputs {
+		if output.Variant != variants[i].name || output.Options != variants[i].hash() {
+			return false
+		}
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(output.Path))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// write writes the manifest atomically, so an interrupted run leaves the
+// previous manifest intact
+func (m *manifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// splitItems parses a comma-separated list, ignoring empty items
+func splitItems(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}